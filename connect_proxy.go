@@ -12,7 +12,13 @@ import (
 
 var port = flag.String("port", "8080", "port number")
 
-type HTTPHeader map[string]string
+type HeaderField struct {
+	Name  string
+	Value string
+}
+
+// Header fields in the received order, with the original case of names
+type HTTPHeader []HeaderField
 
 type Request struct {
 	Method  string
@@ -60,7 +66,7 @@ func (p *requestParser) readRequestLine() error {
 }
 
 func (p *requestParser) readHeaders() error {
-	headers := make(map[string]string)
+	headers := HTTPHeader{}
 	for {
 		line, err := p.readLine()
 		if err != nil {
@@ -73,8 +79,8 @@ func (p *requestParser) readHeaders() error {
 		if len(fs) != 2 {
 			return fmt.Errorf("Invalid header format")
 		}
-		hdr := strings.ToLower(strings.TrimSpace(fs[0]))
-		headers[hdr] = strings.TrimSpace(fs[1])
+		name := strings.TrimSpace(fs[0])
+		headers = append(headers, HeaderField{name, strings.TrimSpace(fs[1])})
 	}
 	p.req.Headers = headers
 	return nil
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// An accessLogEntry records a request and its response.
+type accessLogEntry struct {
+	Time time.Time
+	// Address of the client connection
+	Client string
+	// Authenticated user, if any
+	User    string
+	Method  string
+	URI     string
+	Version string
+	Status  int
+	// Bytes of the response body sent to the client
+	Bytes    int64
+	Duration time.Duration
+	// Address of the server connection, or "" if none was used
+	Upstream  string
+	Referer   string
+	UserAgent string
+}
+
+func (e *accessLogEntry) setRequest(req *Request) {
+	e.Method = req.Method
+	e.URI = req.URI
+	e.Version = req.Version
+	e.Referer = req.Headers.Get("referer")
+	e.UserAgent = req.Headers.Get("user-agent")
+}
+
+// Formats of AccessLog
+const (
+	LogCommon   = "common"
+	LogCombined = "combined"
+	LogJSON     = "json"
+)
+
+// AccessLog writes entries to a file, one per line.
+type AccessLog struct {
+	path   string
+	format string
+
+	mu sync.Mutex
+	w  io.WriteCloser
+}
+
+// NewAccessLog appends to the file at path, or writes to stdout if path is
+// "-".
+func NewAccessLog(path, format string) (*AccessLog, error) {
+	switch format {
+	case LogCommon, LogCombined, LogJSON:
+	default:
+		return nil, fmt.Errorf("Unknown access log format: %s", format)
+	}
+	l := &AccessLog{path: path, format: format}
+	if err := l.Reopen(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// Reopen opens the file again so that it can be rotated.
+func (l *AccessLog) Reopen() error {
+	var w io.WriteCloser = nopCloser{os.Stdout}
+	if l.path != "-" {
+		f, err := os.OpenFile(l.path,
+			os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			return fmt.Errorf("Failed to open access log: %w", err)
+		}
+		w = f
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.w != nil {
+		l.w.Close()
+	}
+	l.w = w
+	return nil
+}
+
+func (l *AccessLog) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.w.Close()
+}
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error {
+	return nil
+}
+
+func (l *AccessLog) Log(e *accessLogEntry) {
+	var line string
+	switch l.format {
+	case LogCommon:
+		line = formatCommon(e) + "\n"
+	case LogCombined:
+		line = formatCombined(e) + "\n"
+	case LogJSON:
+		line = formatJSON(e) + "\n"
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	io.WriteString(l.w, line)
+}
+
+// escapeLogField escapes quotes and control characters in a quoted field,
+// and returns "-" for an empty one.
+func escapeLogField(s string) string {
+	if s == "" {
+		return "-"
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '"' || c == '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c < 0x20 || c >= 0x7f:
+			fmt.Fprintf(&b, "\\x%02x", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+func formatCommon(e *accessLogEntry) string {
+	host := e.Client
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	request := "-"
+	if e.Method != "" {
+		request = escapeLogField(e.Method + " " + e.URI + " " + e.Version)
+	}
+	bytes := "-"
+	if e.Bytes > 0 {
+		bytes = strconv.FormatInt(e.Bytes, 10)
+	}
+	return fmt.Sprintf("%s - %s [%s] \"%s\" %d %s",
+		host, escapeLogField(e.User),
+		e.Time.Format("02/Jan/2006:15:04:05 -0700"), request, e.Status, bytes)
+}
+
+func formatCombined(e *accessLogEntry) string {
+	return fmt.Sprintf("%s \"%s\" \"%s\"", formatCommon(e),
+		escapeLogField(e.Referer), escapeLogField(e.UserAgent))
+}
+
+func formatJSON(e *accessLogEntry) string {
+	b, _ := json.Marshal(struct {
+		Time       string  `json:"time"`
+		Client     string  `json:"client"`
+		User       string  `json:"user,omitempty"`
+		Method     string  `json:"method"`
+		URI        string  `json:"uri"`
+		Version    string  `json:"version"`
+		Status     int     `json:"status"`
+		Bytes      int64   `json:"bytes"`
+		DurationMs float64 `json:"duration_ms"`
+		Upstream   string  `json:"upstream,omitempty"`
+		Referer    string  `json:"referer,omitempty"`
+		UserAgent  string  `json:"user_agent,omitempty"`
+	}{
+		e.Time.Format(time.RFC3339Nano), e.Client, e.User,
+		e.Method, e.URI, e.Version, e.Status, e.Bytes,
+		float64(e.Duration) / float64(time.Millisecond),
+		e.Upstream, e.Referer, e.UserAgent,
+	})
+	return string(b)
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAccessLogFormats(t *testing.T) {
+	e := &accessLogEntry{
+		Time:      time.Date(2024, 3, 1, 12, 34, 56, 0, time.UTC),
+		Client:    "192.0.2.1:54321",
+		Method:    "GET",
+		URI:       "http://example.com/a\"b",
+		Version:   "HTTP/1.1",
+		Status:    200,
+		Bytes:     42,
+		Duration:  1500 * time.Microsecond,
+		Upstream:  "198.51.100.1:80",
+		UserAgent: "curl/8.0",
+	}
+	ExpectEqual(t, "192.0.2.1 - - [01/Mar/2024:12:34:56 +0000] "+
+		"\"GET http://example.com/a\\\"b HTTP/1.1\" 200 42 \"-\" \"curl/8.0\"",
+		formatCombined(e))
+	ExpectEqual(t, "{\"time\":\"2024-03-01T12:34:56Z\","+
+		"\"client\":\"192.0.2.1:54321\",\"method\":\"GET\","+
+		"\"uri\":\"http://example.com/a\\\"b\",\"version\":\"HTTP/1.1\","+
+		"\"status\":200,\"bytes\":42,\"duration_ms\":1.5,"+
+		"\"upstream\":\"198.51.100.1:80\",\"user_agent\":\"curl/8.0\"}",
+		formatJSON(e))
+
+	// Unreadable requests and empty bodies
+	e = &accessLogEntry{Time: e.Time, Client: "192.0.2.1:54321", Status: 400}
+	ExpectEqual(t, "192.0.2.1 - - [01/Mar/2024:12:34:56 +0000] \"-\" 400 -",
+		formatCommon(e))
+}
+
+func TestAccessLogReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	l, err := NewAccessLog(path, LogCommon)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := &accessLogEntry{Client: "192.0.2.1:1", Status: 200}
+	l.Log(e)
+	os.Rename(path, path+".1")
+	l.Log(e)
+	if err := l.Reopen(); err != nil {
+		t.Fatal(err)
+	}
+	l.Log(e)
+
+	b, _ := os.ReadFile(path + ".1")
+	ExpectEqual(t, "2", strconv.Itoa(strings.Count(string(b), "\n")))
+	b, _ = os.ReadFile(path)
+	ExpectEqual(t, "1", strconv.Itoa(strings.Count(string(b), "\n")))
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// An ACL is a list of rules, one per line of a file:
+//
+//	# Comments and blank lines are ignored
+//	allow src=10.0.0.0/8,192.168.0.0/16 port=80,443
+//	deny host=*.internal,localhost reason="Internal hosts"
+//	allow src=127.0.0.1 method=GET,HEAD,CONNECT port=1024-65535
+//	deny
+//
+// A rule matches a request if all of its conditions do, where a condition
+// with a list matches any of its items, and an omitted one matches anything.
+// Hosts are globs matched against the destination host without the port.
+// The first matching rule applies, and requests matching none are denied.
+type ACL struct {
+	rules []aclRule
+}
+
+type aclRule struct {
+	allow   bool
+	nets    []*net.IPNet
+	hosts   []string
+	ports   [][2]int
+	methods []string
+	// Sent to the client when denied
+	reason string
+}
+
+// splitACLLine splits a line at spaces outside double quotes, and removes
+// the quotes.
+func splitACLLine(line string) ([]string, error) {
+	var fields []string
+	var b strings.Builder
+	inField, quoted := false, false
+	for _, c := range line {
+		switch {
+		case c == '"':
+			quoted = !quoted
+			inField = true
+		case (c == ' ' || c == '\t') && !quoted:
+			if inField {
+				fields = append(fields, b.String())
+				b.Reset()
+				inField = false
+			}
+		default:
+			b.WriteRune(c)
+			inField = true
+		}
+	}
+	if quoted {
+		return nil, fmt.Errorf("Unterminated quote")
+	}
+	if inField {
+		fields = append(fields, b.String())
+	}
+	return fields, nil
+}
+
+func parseACLNet(s string) (*net.IPNet, error) {
+	if !strings.Contains(s, "/") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, fmt.Errorf("Invalid address: %s", s)
+		}
+		bits := 8 * net.IPv6len
+		if ip.To4() != nil {
+			ip = ip.To4()
+			bits = 8 * net.IPv4len
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+	_, n, err := net.ParseCIDR(s)
+	return n, err
+}
+
+func parseACLPorts(s string) ([2]int, error) {
+	lo, hi, isRange := strings.Cut(s, "-")
+	if !isRange {
+		hi = lo
+	}
+	l, err1 := strconv.Atoi(lo)
+	h, err2 := strconv.Atoi(hi)
+	if err1 != nil || err2 != nil || l < 1 || h > 65535 || l > h {
+		return [2]int{}, fmt.Errorf("Invalid port: %s", s)
+	}
+	return [2]int{l, h}, nil
+}
+
+func parseACLRule(fields []string) (aclRule, error) {
+	var r aclRule
+	switch fields[0] {
+	case "allow":
+		r.allow = true
+	case "deny":
+	default:
+		return r, fmt.Errorf("Unknown action: %s", fields[0])
+	}
+	for _, f := range fields[1:] {
+		name, value, ok := strings.Cut(f, "=")
+		if !ok || value == "" {
+			return r, fmt.Errorf("Invalid condition: %s", f)
+		}
+		if name == "reason" {
+			r.reason = value
+			continue
+		}
+		for _, item := range strings.Split(value, ",") {
+			switch name {
+			case "src":
+				n, err := parseACLNet(item)
+				if err != nil {
+					return r, err
+				}
+				r.nets = append(r.nets, n)
+			case "host":
+				if _, err := path.Match(item, ""); err != nil {
+					return r, fmt.Errorf("Invalid host pattern: %s", item)
+				}
+				r.hosts = append(r.hosts, strings.ToLower(item))
+			case "port":
+				p, err := parseACLPorts(item)
+				if err != nil {
+					return r, err
+				}
+				r.ports = append(r.ports, p)
+			case "method":
+				r.methods = append(r.methods, strings.ToUpper(item))
+			default:
+				return r, fmt.Errorf("Unknown condition: %s", name)
+			}
+		}
+	}
+	return r, nil
+}
+
+func ParseACL(r io.Reader) (*ACL, error) {
+	a := &ACL{}
+	s := bufio.NewScanner(r)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields, err := splitACLLine(line)
+		if err != nil {
+			return nil, fmt.Errorf("Line %d: %w", n, err)
+		}
+		rule, err := parseACLRule(fields)
+		if err != nil {
+			return nil, fmt.Errorf("Line %d: %w", n, err)
+		}
+		a.rules = append(a.rules, rule)
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func LoadACL(filename string) (*ACL, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to load ACL: %w", err)
+	}
+	defer f.Close()
+	a, err := ParseACL(f)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to load ACL %s: %w", filename, err)
+	}
+	return a, nil
+}
+
+func (r *aclRule) matchesClient(client net.IP) bool {
+	for _, n := range r.nets {
+		if n.Contains(client) {
+			return true
+		}
+	}
+	return r.nets == nil
+}
+
+func (r *aclRule) matchesHost(host string) bool {
+	for _, pattern := range r.hosts {
+		if ok, _ := path.Match(pattern, host); ok {
+			return true
+		}
+	}
+	return r.hosts == nil
+}
+
+func (r *aclRule) matchesPort(port int) bool {
+	for _, p := range r.ports {
+		if p[0] <= port && port <= p[1] {
+			return true
+		}
+	}
+	return r.ports == nil
+}
+
+func (r *aclRule) matchesMethod(method string) bool {
+	for _, m := range r.methods {
+		if m == method {
+			return true
+		}
+	}
+	return r.methods == nil
+}
+
+// Check reports whether a request is allowed, and the reason if not. host
+// is without the port.
+func (a *ACL) Check(client net.IP, host string, port int,
+	method string) (bool, string) {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, r := range a.rules {
+		if !r.matchesClient(client) || !r.matchesHost(host) ||
+			!r.matchesPort(port) || !r.matchesMethod(method) {
+			continue
+		}
+		if r.allow {
+			return true, ""
+		}
+		if r.reason != "" {
+			return false, r.reason
+		}
+		return false, "Access denied"
+	}
+	return false, "Access denied"
+}
+
+// checkRequest applies a to req from clientAddr.
+func (a *ACL) checkRequest(req *Request, clientAddr net.Addr) (bool, string) {
+	var client net.IP
+	if host, _, err := net.SplitHostPort(clientAddr.String()); err == nil {
+		client = net.ParseIP(host)
+	}
+	addr := req.Authority
+	if req.Method != "CONNECT" {
+		addr = appendPortIfNeeded(req.TargetHost())
+	}
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false, "Invalid destination"
+	}
+	port, _ := strconv.Atoi(portStr)
+	return a.Check(client, host, port, req.Method)
+}
+
+// forbiddenResponse returns 403 with reason in the body.
+func forbiddenResponse(reason string) (*Response, []byte) {
+	body := []byte(reason + "\n")
+	res := &Response{Version: "HTTP/1.1", Status: 403, Phrase: "Forbidden"}
+	res.Headers.Add("Content-Type", "text/plain; charset=utf-8")
+	res.Headers.Add("Content-Length", strconv.Itoa(len(body)))
+	return res, body
+}
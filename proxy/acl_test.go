@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestACL(t *testing.T) {
+	a, err := ParseACL(strings.NewReader(`
+# Internal hosts are never reachable
+deny host=*.internal,localhost reason="Internal hosts"
+allow src=10.0.0.0/8,::1 port=80,8000-8999
+allow src=192.0.2.1 method=get
+deny reason="Not allowed"
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	check := func(client, host string, port int, method string) string {
+		ok, reason := a.Check(net.ParseIP(client), host, port, method)
+		if ok {
+			return "allowed"
+		}
+		return reason
+	}
+	ExpectEqual(t, "Internal hosts", check("10.0.0.1", "db.Internal.", 80, "GET"))
+	ExpectEqual(t, "allowed", check("10.1.2.3", "example.com", 8080, "POST"))
+	ExpectEqual(t, "allowed", check("::1", "example.com", 80, "GET"))
+	ExpectEqual(t, "Not allowed", check("10.1.2.3", "example.com", 443, "GET"))
+	ExpectEqual(t, "allowed", check("192.0.2.1", "example.com", 443, "GET"))
+	ExpectEqual(t, "Not allowed", check("192.0.2.1", "example.com", 443, "PUT"))
+
+	for _, rules := range []string{
+		"permit", "allow src=10.0.0.0/33", "allow port=0", "allow port=9-8",
+		"allow host=[", "allow user=foo", "deny reason=\"open",
+	} {
+		if _, err := ParseACL(strings.NewReader(rules)); err == nil {
+			t.Errorf("Invalid rules were accepted: %s", rules)
+		}
+	}
+}
+
+func TestACLForbidden(t *testing.T) {
+	a, err := ParseACL(strings.NewReader("deny reason=\"No way\""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	withSettings(t, func(st *settings) { st.acl = a })
+
+	conn, peer := net.Pipe()
+	go handle(conn)
+	defer peer.Close()
+	go io.WriteString(peer, "GET http://example.com/ HTTP/1.1\r\n\r\n")
+	status, body := readTestResponse(t, bufio.NewReader(peer))
+	ExpectEqual(t, "HTTP/1.1 403 Forbidden", status)
+	ExpectEqual(t, "No way\n", body)
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Htpasswd is the users of an htpasswd file, with passwords hashed by
+// bcrypt ("$2y$...") or SHA-1 ("{SHA}...").
+type Htpasswd struct {
+	hashes map[string]string
+	// Checked for unknown users, so that they can't be told by the time
+	// bcrypt takes, or "" if there's no bcrypt hash
+	dummy string
+
+	// SHA-256 of "user:password" known to match, as bcrypt is too slow to
+	// run on every request
+	mu       sync.Mutex
+	verified map[[sha256.Size]byte]bool
+}
+
+func ParseHtpasswd(r io.Reader) (*Htpasswd, error) {
+	h := &Htpasswd{
+		hashes:   make(map[string]string),
+		verified: make(map[[sha256.Size]byte]bool),
+	}
+	s := bufio.NewScanner(r)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		user, hash, ok := strings.Cut(line, ":")
+		if !ok || user == "" {
+			return nil, fmt.Errorf("Line %d: Invalid entry", n)
+		}
+		if !strings.HasPrefix(hash, "$2") && !strings.HasPrefix(hash, "{SHA}") {
+			return nil, fmt.Errorf("Line %d: Unsupported hash for %s", n, user)
+		}
+		h.hashes[user] = hash
+		// As costly as the costliest
+		if parts := strings.Split(hash, "$"); len(parts) == 4 &&
+			(h.dummy == "" || parts[2] > strings.Split(h.dummy, "$")[2]) {
+			h.dummy = "$2y$" + parts[2] + "$" + strings.Repeat(".", 53)
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+func LoadHtpasswd(filename string) (*Htpasswd, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to load htpasswd: %w", err)
+	}
+	defer f.Close()
+	h, err := ParseHtpasswd(f)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to load htpasswd %s: %w", filename, err)
+	}
+	return h, nil
+}
+
+func (h *Htpasswd) Authenticate(user, password string) bool {
+	hash, ok := h.hashes[user]
+	if !ok {
+		if h.dummy != "" {
+			checkBcrypt(h.dummy, password)
+		}
+		return false
+	}
+	key := sha256.Sum256([]byte(user + ":" + password))
+	h.mu.Lock()
+	verified := h.verified[key]
+	h.mu.Unlock()
+	if verified {
+		return true
+	}
+
+	if strings.HasPrefix(hash, "{SHA}") {
+		sum := sha1.Sum([]byte(password))
+		expected := base64.StdEncoding.EncodeToString(sum[:])
+		return subtle.ConstantTimeCompare(
+			[]byte(expected), []byte(hash[len("{SHA}"):])) == 1
+	}
+	if ok, _ := checkBcrypt(hash, password); !ok {
+		return false
+	}
+	h.mu.Lock()
+	h.verified[key] = true
+	h.mu.Unlock()
+	return true
+}
+
+// basicCredentials returns the user and password in Proxy-Authorization.
+func basicCredentials(req *Request) (string, string, bool) {
+	scheme, cred, ok := strings.Cut(req.Headers.Get("proxy-authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Basic") {
+		return "", "", false
+	}
+	b, err := base64.StdEncoding.DecodeString(strings.TrimSpace(cred))
+	if err != nil {
+		return "", "", false
+	}
+	return strings.Cut(string(b), ":")
+}
+
+// authenticate returns the user of req, or "" if it isn't authenticated.
+func (h *Htpasswd) authenticate(req *Request) string {
+	user, password, ok := basicCredentials(req)
+	if !ok || !h.Authenticate(user, password) {
+		return ""
+	}
+	return user
+}
+
+func proxyAuthRequiredResponse(realm string) (*Response, []byte) {
+	body := []byte("Proxy authentication required\n")
+	res := &Response{
+		Version: "HTTP/1.1",
+		Status:  407,
+		Phrase:  "Proxy Authentication Required",
+	}
+	res.Headers.Add("Proxy-Authenticate",
+		"Basic realm=\""+realm+"\", charset=\"UTF-8\"")
+	res.Headers.Add("Content-Type", "text/plain; charset=utf-8")
+	res.Headers.Add("Content-Length", strconv.Itoa(len(body)))
+	return res, body
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestBcrypt(t *testing.T) {
+	// Hashed by crypt(3) of libxcrypt
+	for _, c := range []struct{ hash, password string }{
+		{"$2b$04$abcdefghijklmnopqrstuughE8Ev8uGFaUgY2cNEySvxngrb/Jzdm",
+			"password"},
+		{"$2y$05$saltsaltsaltsaltsaltsOdAGoTcbjCUi8SBsX.cDjcnqmWggLGN2",
+			"s3cr3t pässword"},
+		{"$2a$04$......................w74bL5gU7LSJClZClCa.Pkz14aTv/XO", ""},
+		// Passwords are truncated to 72 bytes
+		{"$2b$04$abcdefghijklmnopqrstuubzadhGtS2zEF.gu0yd0opP6cVzb.e0i",
+			strings.Repeat("x", 80)},
+	} {
+		if ok, err := checkBcrypt(c.hash, c.password); !ok || err != nil {
+			t.Errorf("Password didn't match %s: %v", c.hash, err)
+		}
+		if ok, _ := checkBcrypt(c.hash, c.password+"?"); ok &&
+			len(c.password) < 72 {
+			t.Errorf("Wrong password matched %s", c.hash)
+		}
+	}
+	_, err := checkBcrypt(
+		"$2x$04$abcdefghijklmnopqrstuughE8Ev8uGFaUgY2cNEySvxngrb/Jzdm", "")
+	if err == nil {
+		t.Errorf("Unsupported version was accepted")
+	}
+}
+
+func TestHtpasswd(t *testing.T) {
+	h, err := ParseHtpasswd(strings.NewReader(
+		"alice:$2b$04$abcdefghijklmnopqrstuughE8Ev8uGFaUgY2cNEySvxngrb/Jzdm\n" +
+			"bob:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		user, password string
+		ok             bool
+	}{
+		{"alice", "password", true},
+		// From the verified cache
+		{"alice", "password", true},
+		{"alice", "Password", false},
+		{"bob", "password", true},
+		{"bob", "", false},
+		{"carol", "password", false},
+	} {
+		if h.Authenticate(c.user, c.password) != c.ok {
+			t.Errorf("Unexpected result for %s:%s", c.user, c.password)
+		}
+	}
+	// Unknown users cost as much as the costliest hash
+	h, _ = ParseHtpasswd(strings.NewReader(
+		"alice:$2b$04$abcdefghijklmnopqrstuughE8Ev8uGFaUgY2cNEySvxngrb/Jzdm\n" +
+			"carol:$2y$05$saltsaltsaltsaltsaltsOdAGoTcbjCUi8SBsX.cDjcnqmWggLGN2\n"))
+	ExpectEqual(t, "$2y$05$", h.dummy[:7])
+	if _, err := checkBcrypt(h.dummy, "password"); err != nil {
+		t.Errorf("Invalid dummy hash: %v", err)
+	}
+	if _, err := ParseHtpasswd(strings.NewReader("dave:$apr1$x$y")); err == nil {
+		t.Errorf("Unsupported hash was accepted")
+	}
+}
+
+func TestProxyAuthRequired(t *testing.T) {
+	h, err := ParseHtpasswd(strings.NewReader(
+		"bob:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	withSettings(t, func(st *settings) { st.auth = h })
+
+	ln, accepted := listen(t)
+	defer ln.Close()
+	go func() {
+		conn := <-accepted
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil || line == "\r\n" {
+				break
+			}
+			if strings.HasPrefix(line, "Proxy-Authorization") {
+				io.WriteString(conn, "HTTP/1.1 500 Leaked\r\n\r\n")
+				return
+			}
+		}
+		io.WriteString(conn, "HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok")
+	}()
+
+	conn, peer := net.Pipe()
+	go handle(conn)
+	defer peer.Close()
+	r := bufio.NewReader(peer)
+	url := "http://" + ln.Addr().String() + "/"
+
+	go io.WriteString(peer, "GET "+url+" HTTP/1.1\r\n\r\n")
+	status, _ := readTestResponse(t, r)
+	ExpectEqual(t, "HTTP/1.1 407 Proxy Authentication Required", status)
+
+	cred := base64.StdEncoding.EncodeToString([]byte("bob:password"))
+	go io.WriteString(peer, "GET "+url+" HTTP/1.1\r\n"+
+		"Proxy-Authorization: Basic "+cred+"\r\n\r\n")
+	status, body := readTestResponse(t, r)
+	ExpectEqual(t, "HTTP/1.1 200 OK", status)
+	ExpectEqual(t, "ok", body)
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Policies of choosing a backend
+const (
+	BalanceRoundRobin = "round_robin"
+	BalanceLeastConn  = "least_conn"
+	// Consistent hashing of the client IP, the URI or a header field
+	BalanceHash = "hash"
+)
+
+// HealthCheckConfig makes a route check its backends actively.
+type HealthCheckConfig struct {
+	// Requested with GET, where 2xx and 3xx are healthy
+	Path     string   `json:"path"`
+	Interval Duration `json:"interval"`
+	Timeout  Duration `json:"timeout"`
+}
+
+var ResponseServiceUnavailable = &Response{
+	Version: "HTTP/1.1",
+	Status:  503,
+	Phrase:  "Service Unavailable",
+}
+
+// errNoBackend is returned when every backend of a route is down.
+var errNoBackend = errors.New("No healthy backend")
+
+// Points of each backend on the hash ring
+const hashReplicas = 100
+
+// A backend is a server of a route.
+type backend struct {
+	addr string
+
+	mu sync.Mutex
+	// Requests in flight
+	active int
+	// Consecutive failures, and until when it's ejected after too many
+	fails        int
+	ejectedUntil time.Time
+	// Whether the last health check failed
+	down bool
+}
+
+func (b *backend) healthy(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return !b.down && !now.Before(b.ejectedUntil)
+}
+
+func (b *backend) acquire() {
+	b.mu.Lock()
+	b.active++
+	b.mu.Unlock()
+}
+
+// release, succeeded and failed do nothing if b is nil, which is the case
+// for requests not to a backend.
+func (b *backend) release() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	b.active--
+	b.mu.Unlock()
+}
+
+func (b *backend) succeeded() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	b.fails = 0
+	b.mu.Unlock()
+}
+
+// failed ejects b for failTimeout after maxFails consecutive failures.
+func (b *backend) failed(maxFails int, failTimeout time.Duration) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.fails++
+	if b.fails >= maxFails {
+		if time.Now().After(b.ejectedUntil) {
+			log.Printf("backend ejected: %s: %d failures\n", b.addr, b.fails)
+		}
+		b.ejectedUntil = time.Now().Add(failTimeout)
+		b.fails = 0
+	}
+}
+
+// setHealth records the error of a health check, where a healthy one also
+// reinstates b if it's been ejected.
+func (b *backend) setHealth(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	down := err != nil
+	if down && !b.down {
+		log.Printf("backend down: %s: %v\n", b.addr, err)
+	} else if !down && b.down {
+		log.Printf("backend up: %s\n", b.addr)
+	}
+	b.down = down
+	if !down {
+		b.fails = 0
+		b.ejectedUntil = time.Time{}
+	}
+}
+
+func (b *backend) activeRequests() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.active
+}
+
+type hashPoint struct {
+	hash    uint32
+	backend *backend
+}
+
+// A balancer chooses backends of a route.
+type balancer struct {
+	policy   string
+	backends []*backend
+	// Sorted by hash for BalanceHash
+	ring []hashPoint
+
+	mu   sync.Mutex
+	next int
+}
+
+func hashString(s string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(s))
+	return h.Sum32()
+}
+
+func newBalancer(policy string, addrs []string) *balancer {
+	lb := &balancer{policy: policy}
+	for _, addr := range addrs {
+		b := &backend{addr: addr}
+		lb.backends = append(lb.backends, b)
+		if policy == BalanceHash {
+			for i := 0; i < hashReplicas; i++ {
+				lb.ring = append(lb.ring,
+					hashPoint{hashString(addr + "#" + strconv.Itoa(i)), b})
+			}
+		}
+	}
+	sort.Slice(lb.ring, func(i, j int) bool {
+		return lb.ring[i].hash < lb.ring[j].hash
+	})
+	return lb
+}
+
+// pick returns a healthy backend not in tried, or nil if there's none. Key
+// is used by BalanceHash.
+func (lb *balancer) pick(key string, tried map[*backend]bool) *backend {
+	now := time.Now()
+	usable := func(b *backend) bool {
+		return !tried[b] && b.healthy(now)
+	}
+	if lb.policy == BalanceHash {
+		// The first usable point clockwise from the key
+		h := hashString(key)
+		start := sort.Search(len(lb.ring), func(i int) bool {
+			return lb.ring[i].hash >= h
+		})
+		for i := range lb.ring {
+			p := lb.ring[(start+i)%len(lb.ring)]
+			if usable(p.backend) {
+				return p.backend
+			}
+		}
+		return nil
+	}
+
+	lb.mu.Lock()
+	start := lb.next
+	lb.next = (lb.next + 1) % len(lb.backends)
+	lb.mu.Unlock()
+	var picked *backend
+	for i := range lb.backends {
+		b := lb.backends[(start+i)%len(lb.backends)]
+		if !usable(b) {
+			continue
+		}
+		if lb.policy == BalanceRoundRobin {
+			return b
+		}
+		// Ties go to the next in turn
+		if picked == nil || b.activeRequests() < picked.activeRequests() {
+			picked = b
+		}
+	}
+	return picked
+}
+
+// balanceKey returns the key of req from clientAddr for BalanceHash.
+func (r *route) balanceKey(req *Request, clientAddr net.Addr) string {
+	switch {
+	case r.HashKey == "uri":
+		return req.URI
+	case strings.HasPrefix(r.HashKey, "header:"):
+		return req.Headers.Joined(strings.TrimPrefix(r.HashKey, "header:"))
+	}
+	return clientIP(clientAddr)
+}
+
+// dial connects to a backend chosen for req, trying the others in turn if
+// it fails. The backend must be released after the request.
+func (r *route) dial(
+	req *Request, clientAddr net.Addr) (*upstreamConn, *backend, error) {
+	key := ""
+	if r.Balance == BalanceHash {
+		key = r.balanceKey(req, clientAddr)
+	}
+	tried := make(map[*backend]bool)
+	err := errNoBackend
+	for range r.lb.backends {
+		b := r.lb.pick(key, tried)
+		if b == nil {
+			break
+		}
+		tried[b] = true
+		b.acquire()
+		c, derr := upstreamPool.Get(b.addr)
+		if derr == nil {
+			return c, b, nil
+		}
+		log.Printf("backend failed: %s: %v\n", b.addr, derr)
+		b.release()
+		r.failed(b)
+		err = derr
+	}
+	return nil, nil, err
+}
+
+func (r *route) failed(b *backend) {
+	b.failed(r.MaxFails, time.Duration(r.FailTimeout))
+}
+
+// checkHealth requests the health check path from b.
+func (r *route) checkHealth(b *backend) error {
+	timeout := time.Duration(r.HealthCheck.Timeout)
+	conn, err := net.DialTimeout("tcp", b.addr, timeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+	host := r.HostHeader
+	if host == "" {
+		host = b.addr
+	}
+	req := &Request{Method: "GET", URI: r.HealthCheck.Path, Version: "HTTP/1.1"}
+	req.Headers.Add("Host", host)
+	req.Headers.Add("Connection", "close")
+	sv := NewServerHandler(conn, conn)
+	sv.writeRequest(req)
+	if err := sv.readResponseHeader(); err != nil {
+		return err
+	}
+	if sv.res.Status/100 != 2 && sv.res.Status/100 != 3 {
+		return fmt.Errorf("Health check of %s failed: %d %s",
+			b.addr, sv.res.Status, sv.res.Phrase)
+	}
+	return nil
+}
+
+// checkHealthLoop checks the backends at the interval until quit is
+// closed.
+func (r *route) checkHealthLoop(quit chan struct{}) {
+	ticker := time.NewTicker(time.Duration(r.HealthCheck.Interval))
+	defer ticker.Stop()
+	for {
+		var wg sync.WaitGroup
+		for _, b := range r.lb.backends {
+			wg.Add(1)
+			go func(b *backend) {
+				defer wg.Done()
+				b.setHealth(r.checkHealth(b))
+			}(b)
+		}
+		wg.Wait()
+		select {
+		case <-ticker.C:
+		case <-quit:
+			return
+		}
+	}
+}
+
+// start starts the health checks of the routes, which run until stop. It
+// does nothing if they've been started.
+func (rs *Routes) start() {
+	if rs == nil || rs.quit != nil {
+		return
+	}
+	rs.quit = make(chan struct{})
+	for _, r := range rs.routes {
+		if r.HealthCheck != nil {
+			go r.checkHealthLoop(rs.quit)
+		}
+	}
+}
+
+func (rs *Routes) stop() {
+	if rs != nil && rs.quit != nil {
+		close(rs.quit)
+	}
+}
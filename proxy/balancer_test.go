@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testRoute(t *testing.T, c RouteConfig) *route {
+	rs, err := NewRoutes([]RouteConfig{c})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rs.routes[0]
+}
+
+func TestBalancer(t *testing.T) {
+	backends := []string{"a:80", "b:80", "c:80"}
+	picks := func(lb *balancer, key string, n int) string {
+		var addrs []string
+		for i := 0; i < n; i++ {
+			b := lb.pick(key, nil)
+			if b == nil {
+				addrs = append(addrs, "-")
+				continue
+			}
+			addrs = append(addrs, b.addr)
+		}
+		return strings.Join(addrs, " ")
+	}
+
+	lb := newBalancer(BalanceRoundRobin, backends)
+	ExpectEqual(t, "a:80 b:80 c:80 a:80", picks(lb, "", 4))
+
+	lb = newBalancer(BalanceLeastConn, backends)
+	lb.backends[0].acquire()
+	lb.backends[1].acquire()
+	ExpectEqual(t, "c:80", picks(lb, "", 1))
+	lb.backends[2].acquire()
+	lb.backends[2].acquire()
+	lb.backends[0].release()
+	ExpectEqual(t, "a:80", picks(lb, "", 1))
+
+	// The same key sticks to a backend, and only those on a removed one move
+	lb = newBalancer(BalanceHash, backends)
+	sticky := picks(lb, "10.0.0.1", 1)
+	ExpectEqual(t, sticky+" "+sticky, picks(lb, "10.0.0.1", 2))
+	before := make(map[string]string)
+	for i := 0; i < 100; i++ {
+		key := "10.0.0." + strconv.Itoa(i)
+		before[key] = picks(lb, key, 1)
+	}
+	lb.backends[0].setHealth(io.EOF)
+	for key, addr := range before {
+		if after := picks(lb, key, 1); addr != "a:80" && after != addr {
+			t.Errorf("Key %s moved from %s to %s", key, addr, after)
+		}
+	}
+
+	// Tried backends are skipped
+	lb = newBalancer(BalanceRoundRobin, backends[:1])
+	tried := map[*backend]bool{lb.backends[0]: true}
+	if lb.pick("", tried) != nil {
+		t.Errorf("Tried backend was picked")
+	}
+}
+
+func TestBackendEjection(t *testing.T) {
+	r := testRoute(t, RouteConfig{Backends: []string{"a:80", "b:80"},
+		MaxFails: 2, FailTimeout: Duration(time.Hour)})
+	a := r.lb.backends[0]
+	r.failed(a)
+	r.failed(a)
+	ExpectEqual(t, "false", strconv.FormatBool(a.healthy(time.Now())))
+	ExpectEqual(t, "b:80 b:80", r.lb.pick("", nil).addr+" "+
+		r.lb.pick("", nil).addr)
+	ExpectEqual(t, "true",
+		strconv.FormatBool(a.healthy(time.Now().Add(2*time.Hour))))
+
+	// A success resets the count
+	b := r.lb.backends[1]
+	r.failed(b)
+	b.succeeded()
+	r.failed(b)
+	ExpectEqual(t, "true", strconv.FormatBool(b.healthy(time.Now())))
+
+	// A healthy check reinstates an ejected backend
+	a.setHealth(nil)
+	ExpectEqual(t, "true", strconv.FormatBool(a.healthy(time.Now())))
+
+	r.failed(b)
+	r.failed(b)
+	r.failed(a)
+	r.failed(a)
+	if _, _, err := r.dial(&Request{URI: "/"}, nil); err != errNoBackend {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
+func TestHealthCheck(t *testing.T) {
+	ln, accepted := listen(t)
+	defer ln.Close()
+	status := make(chan string, 1)
+	go func() {
+		for conn := range accepted {
+			lines := readTestRequestHeader(bufio.NewReader(conn))
+			ExpectEqual(t, "GET /healthz HTTP/1.1", lines[0])
+			io.WriteString(conn, "HTTP/1.1 "+<-status+"\r\n"+
+				"Content-Length: 0\r\n\r\n")
+			conn.Close()
+		}
+	}()
+	r := testRoute(t, RouteConfig{Backend: ln.Addr().String(),
+		HealthCheck: &HealthCheckConfig{Path: "/healthz"}})
+	b := r.lb.backends[0]
+
+	status <- "503 Service Unavailable"
+	b.setHealth(r.checkHealth(b))
+	ExpectEqual(t, "false", strconv.FormatBool(b.healthy(time.Now())))
+	status <- "200 OK"
+	b.setHealth(r.checkHealth(b))
+	ExpectEqual(t, "true", strconv.FormatBool(b.healthy(time.Now())))
+}
+
+func TestBalancedReverseProxy(t *testing.T) {
+	ln, accepted := listen(t)
+	defer ln.Close()
+	go func() {
+		for conn := range accepted {
+			go func(conn net.Conn) {
+				defer conn.Close()
+				readTestRequestHeader(bufio.NewReader(conn))
+				io.WriteString(conn, "HTTP/1.1 200 OK\r\n"+
+					"Connection: close\r\nContent-Length: 2\r\n\r\nok")
+			}(conn)
+		}
+	}()
+	dead, _ := listen(t)
+	dead.Close()
+	rs, err := NewRoutes([]RouteConfig{{
+		Backends: []string{dead.Addr().String(), ln.Addr().String()},
+		MaxFails: 1, FailTimeout: Duration(time.Hour)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	withSettings(t, func(st *settings) { st.routes = rs })
+
+	conn, peer := net.Pipe()
+	go handle(conn)
+	defer peer.Close()
+	r := bufio.NewReader(peer)
+	// The dead backend is ejected, and the request goes to the other
+	for i := 0; i < 2; i++ {
+		go io.WriteString(peer, "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n")
+		status, body := readTestResponse(t, r)
+		ExpectEqual(t, "HTTP/1.1 200 OK", status)
+		ExpectEqual(t, "ok", body)
+	}
+	ExpectEqual(t, "false", strconv.FormatBool(
+		rs.routes[0].lb.backends[0].healthy(time.Now())))
+}
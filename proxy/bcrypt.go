@@ -0,0 +1,185 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// bcrypt, the Blowfish-based password hash of OpenBSD, for htpasswd files.
+
+type blowfish struct {
+	p [18]uint32
+	s [4][256]uint32
+}
+
+// The initial state of Blowfish is the fractional part of pi in hex, which
+// is computed once when needed rather than kept as a table.
+var blowfishInit struct {
+	once sync.Once
+	c    blowfish
+}
+
+// piWords returns the first n 32-bit words of the fractional part of pi.
+func piWords(n int) []uint32 {
+	// pi = 16 atan(1/5) - 4 atan(1/239) in fixed point with guard bits
+	const guard = 64
+	bits := uint(32*n + guard)
+	one := new(big.Int).Lsh(big.NewInt(1), bits)
+	atanInv := func(x int64) *big.Int {
+		sum := new(big.Int)
+		term := new(big.Int).Div(one, big.NewInt(x))
+		x2 := big.NewInt(x * x)
+		t := new(big.Int)
+		for k := int64(0); term.Sign() != 0; k++ {
+			t.Div(term, big.NewInt(2*k+1))
+			if k%2 == 0 {
+				sum.Add(sum, t)
+			} else {
+				sum.Sub(sum, t)
+			}
+			term.Div(term, x2)
+		}
+		return sum
+	}
+	pi := new(big.Int).Mul(atanInv(5), big.NewInt(16))
+	pi.Sub(pi, new(big.Int).Mul(atanInv(239), big.NewInt(4)))
+	pi.Sub(pi, new(big.Int).Lsh(big.NewInt(3), bits))
+	pi.Rsh(pi, guard)
+
+	b := pi.FillBytes(make([]byte, 4*n))
+	words := make([]uint32, n)
+	for i := range words {
+		words[i] = binary.BigEndian.Uint32(b[4*i:])
+	}
+	return words
+}
+
+func initialBlowfish() blowfish {
+	blowfishInit.once.Do(func() {
+		words := piWords(18 + 4*256)
+		c := &blowfishInit.c
+		copy(c.p[:], words)
+		for i := range c.s {
+			copy(c.s[i][:], words[18+256*i:])
+		}
+	})
+	return blowfishInit.c
+}
+
+func (c *blowfish) f(x uint32) uint32 {
+	return ((c.s[0][x>>24] + c.s[1][x>>16&0xff]) ^ c.s[2][x>>8&0xff]) +
+		c.s[3][x&0xff]
+}
+
+func (c *blowfish) encrypt(l, r uint32) (uint32, uint32) {
+	l ^= c.p[0]
+	for i := 1; i < 16; i += 2 {
+		r ^= c.f(l) ^ c.p[i]
+		l ^= c.f(r) ^ c.p[i+1]
+	}
+	r ^= c.p[17]
+	return r, l
+}
+
+// streamWord returns the next 4 bytes of b, cycling from the start.
+func streamWord(b []byte, pos *int) uint32 {
+	var w uint32
+	for i := 0; i < 4; i++ {
+		w = w<<8 | uint32(b[*pos])
+		*pos = (*pos + 1) % len(b)
+	}
+	return w
+}
+
+// expandKey is the key schedule of Blowfish, with salt mixed in unless it's
+// nil.
+func (c *blowfish) expandKey(key, salt []byte) {
+	pos := 0
+	for i := range c.p {
+		c.p[i] ^= streamWord(key, &pos)
+	}
+	pos = 0
+	var l, r uint32
+	next := func() {
+		if salt != nil {
+			l ^= streamWord(salt, &pos)
+			r ^= streamWord(salt, &pos)
+		}
+		l, r = c.encrypt(l, r)
+	}
+	for i := 0; i < len(c.p); i += 2 {
+		next()
+		c.p[i], c.p[i+1] = l, r
+	}
+	for i := range c.s {
+		for j := 0; j < 256; j += 2 {
+			next()
+			c.s[i][j], c.s[i][j+1] = l, r
+		}
+	}
+}
+
+var bcryptEncoding = base64.NewEncoding(
+	"./ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789").
+	WithPadding(base64.NoPadding)
+
+// bcrypt returns the 23-byte hash of password.
+func bcrypt(password []byte, cost int, salt []byte) []byte {
+	key := append(append([]byte{}, password...), 0)
+	if len(key) > 72 {
+		key = key[:72]
+	}
+	c := initialBlowfish()
+	c.expandKey(key, salt)
+	for i := 0; i < 1<<cost; i++ {
+		c.expandKey(key, nil)
+		c.expandKey(salt, nil)
+	}
+
+	const magic = "OrpheanBeholderScryDoubt"
+	var words [6]uint32
+	for i := range words {
+		words[i] = binary.BigEndian.Uint32([]byte(magic[4*i:]))
+	}
+	for n := 0; n < 64; n++ {
+		for i := 0; i < len(words); i += 2 {
+			words[i], words[i+1] = c.encrypt(words[i], words[i+1])
+		}
+	}
+	out := make([]byte, 24)
+	for i, w := range words {
+		binary.BigEndian.PutUint32(out[4*i:], w)
+	}
+	return out[:23]
+}
+
+// checkBcrypt reports whether password matches a hash like
+// "$2y$10$<22 characters of salt><31 characters of hash>".
+func checkBcrypt(hash, password string) (bool, error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 4 || parts[0] != "" || len(parts[3]) != 53 {
+		return false, fmt.Errorf("Invalid bcrypt hash")
+	}
+	switch parts[1] {
+	case "2a", "2b", "2y":
+	default:
+		return false, fmt.Errorf("Unsupported bcrypt version: %s", parts[1])
+	}
+	cost, err := strconv.Atoi(parts[2])
+	if err != nil || cost < 4 || cost > 31 {
+		return false, fmt.Errorf("Invalid bcrypt cost: %s", parts[2])
+	}
+	salt, err := bcryptEncoding.DecodeString(parts[3][:22])
+	if err != nil {
+		return false, fmt.Errorf("Invalid bcrypt salt: %w", err)
+	}
+	sum := bcryptEncoding.EncodeToString(bcrypt([]byte(password), cost, salt))
+	return subtle.ConstantTimeCompare([]byte(sum), []byte(parts[3][22:])) == 1,
+		nil
+}
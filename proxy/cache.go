@@ -0,0 +1,505 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A shared HTTP cache in the manner of RFC 9111. Only responses to GET are
+// stored, keyed by the absolute URI and the request headers named in Vary.
+
+// A cacheEntry is a stored response. Entries aren't modified once stored,
+// and are replaced instead.
+type cacheEntry struct {
+	Key string
+	Res *Response
+	// Values of the request headers named in Vary, by lower-case name
+	Vary map[string]string
+	// When the request was sent and the response was received
+	RequestTime  time.Time
+	ResponseTime time.Time
+	BodySize     int64
+
+	// Used by the stores
+	body   []byte
+	bodyID string
+}
+
+// cacheStore keeps cache entries and their bodies.
+type cacheStore interface {
+	// lookup returns the entry for key whose Vary matches req, or nil.
+	lookup(key string, req *Request) *cacheEntry
+	open(e *cacheEntry) (io.ReadCloser, error)
+	// create starts storing e, which replaces the entry with the same key
+	// and Vary when committed.
+	create(e *cacheEntry) (cacheWriter, error)
+	// update replaces the stored old with e having the same body.
+	update(old, e *cacheEntry)
+	// remove removes all the entries for key.
+	remove(key string)
+}
+
+// A cacheWriter receives the body of a new entry.
+type cacheWriter interface {
+	io.Writer
+	commit() error
+	abort()
+}
+
+type Cache struct {
+	store cacheStore
+	// Larger responses aren't stored
+	maxObjectSize int64
+}
+
+func NewCache(store cacheStore, maxObjectSize int64) *Cache {
+	return &Cache{store: store, maxObjectSize: maxObjectSize}
+}
+
+// responseCache is nil if caching is disabled.
+var responseCache *Cache
+
+// Cache-Control directives by lower-case name. Values are unquoted.
+type cacheControl map[string]string
+
+func parseCacheControl(v string) cacheControl {
+	cc := cacheControl{}
+	for _, d := range strings.Split(v, ",") {
+		d = strings.TrimSpace(d)
+		if d == "" {
+			continue
+		}
+		name, value := d, ""
+		if pos := strings.Index(d, "="); pos != -1 {
+			name, value = d[:pos], strings.Trim(d[pos+1:], "\"")
+		}
+		cc[strings.ToLower(strings.TrimSpace(name))] = value
+	}
+	return cc
+}
+
+func (cc cacheControl) has(name string) bool {
+	_, ok := cc[name]
+	return ok
+}
+
+// seconds returns the value of a delta-seconds directive.
+func (cc cacheControl) seconds(name string) (time.Duration, bool) {
+	v, ok := cc[name]
+	if !ok {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n < 0 {
+		return 0, false
+	}
+	return time.Duration(n) * time.Second, true
+}
+
+const httpTimeFormat = "Mon, 02 Jan 2006 15:04:05 GMT"
+
+// parseHTTPTime accepts the obsolete formats too (RFC 9110 section 5.6.7).
+func parseHTTPTime(v string) (time.Time, bool) {
+	layouts := []string{
+		httpTimeFormat,
+		"Monday, 02-Jan-06 15:04:05 GMT",
+		"Mon Jan _2 15:04:05 2006",
+	}
+	for _, layout := range layouts {
+		if t, err := time.Parse(layout, v); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+func formatHTTPTime(t time.Time) string {
+	return t.UTC().Format(httpTimeFormat)
+}
+
+// cacheKey returns the absolute URI of req.
+func cacheKey(req *Request) string {
+	host := strings.TrimSuffix(strings.ToLower(req.TargetHost()), ":80")
+	return "http://" + host + req.originForm()
+}
+
+// Status codes that are cacheable by default (RFC 9110 section 15.1)
+var cacheableStatus = map[int]bool{
+	200: true, 203: true, 204: true, 300: true, 301: true, 308: true,
+	404: true, 405: true, 410: true, 414: true, 501: true,
+}
+
+func (e *cacheEntry) date() time.Time {
+	if t, ok := parseHTTPTime(e.Res.Headers.Get("date")); ok {
+		return t
+	}
+	return e.ResponseTime
+}
+
+// lifetime returns how long e is fresh for.
+func (e *cacheEntry) lifetime() time.Duration {
+	cc := parseCacheControl(e.Res.Headers.Joined("cache-control"))
+	if cc.has("no-cache") {
+		return 0
+	}
+	if d, ok := cc.seconds("s-maxage"); ok {
+		return d
+	}
+	if d, ok := cc.seconds("max-age"); ok {
+		return d
+	}
+	if v := e.Res.Headers.Get("expires"); v != "" {
+		// Invalid dates mean already expired
+		t, ok := parseHTTPTime(v)
+		if !ok || t.Before(e.date()) {
+			return 0
+		}
+		return t.Sub(e.date())
+	}
+	// Heuristic freshness of 10% of the time since the last modification
+	if t, ok := parseHTTPTime(e.Res.Headers.Get("last-modified")); ok {
+		d := e.date().Sub(t) / 10
+		if d > 24*time.Hour {
+			d = 24 * time.Hour
+		}
+		if d > 0 {
+			return d
+		}
+	}
+	return 0
+}
+
+// age returns the current age of e (RFC 9111 section 4.2.3).
+func (e *cacheEntry) age(now time.Time) time.Duration {
+	apparent := e.ResponseTime.Sub(e.date())
+	if apparent < 0 {
+		apparent = 0
+	}
+	var ageValue time.Duration
+	if n, err := strconv.ParseInt(e.Res.Headers.Get("age"), 10, 64); err == nil {
+		ageValue = time.Duration(n) * time.Second
+	}
+	corrected := ageValue + e.ResponseTime.Sub(e.RequestTime)
+	if corrected < apparent {
+		corrected = apparent
+	}
+	return corrected + now.Sub(e.ResponseTime)
+}
+
+// matches reports whether the request headers named in Vary are the same.
+func (e *cacheEntry) matches(req *Request) bool {
+	for name, v := range e.Vary {
+		if req.Headers.Joined(name) != v {
+			return false
+		}
+	}
+	return true
+}
+
+// response returns the stored response with Age set.
+func (e *cacheEntry) response(now time.Time) *Response {
+	res := *e.Res
+	res.Headers = e.Res.Headers.Clone()
+	res.Headers.Set("Age", strconv.Itoa(int(e.age(now)/time.Second)))
+	return &res
+}
+
+// withBodySize returns a copy of e with the size of the stored body, which
+// is sent with Content-Length rather than chunked.
+func (e *cacheEntry) withBodySize(n int64) *cacheEntry {
+	ne := *e
+	ne.BodySize = n
+	res := *e.Res
+	res.Headers = e.Res.Headers.Clone()
+	res.Headers.Del("transfer-encoding")
+	res.Headers.Set("Content-Length", strconv.FormatInt(n, 10))
+	ne.Res = &res
+	return &ne
+}
+
+// Fields of a 304 response that don't replace the stored ones
+var keepOnRevalidation = []string{
+	"content-length", "transfer-encoding", "content-encoding", "via",
+}
+
+// revalidated returns a copy of e with the header fields of a 304
+// response res replacing the stored ones.
+func (e *cacheEntry) revalidated(
+	res *Response, requestTime, responseTime time.Time) *cacheEntry {
+	ne := *e
+	stored := *e.Res
+	stored.Headers = e.Res.Headers.Clone()
+	done := map[string]bool{}
+	for _, name := range keepOnRevalidation {
+		done[name] = true
+	}
+	for _, f := range res.Headers {
+		name := strings.ToLower(f.Name)
+		if done[name] {
+			continue
+		}
+		done[name] = true
+		stored.Headers.Del(name)
+		for _, v := range res.Headers.Values(name) {
+			stored.Headers.Add(f.Name, v)
+		}
+	}
+	ne.Res = &stored
+	ne.RequestTime = requestTime
+	ne.ResponseTime = responseTime
+	return &ne
+}
+
+// cacheExchange is the part of a transaction dealing with the cache.
+type cacheExchange struct {
+	cache *Cache
+	req   *Request
+	key   string
+	cc    cacheControl
+	// Stored response matching req, if any
+	entry *cacheEntry
+	// Whether the request to the server is conditional on entry
+	validating  bool
+	requestTime time.Time
+	w           cacheWriter
+	written     int64
+}
+
+// newExchange returns nil if req can't be served from the cache.
+func (c *Cache) newExchange(req *Request) *cacheExchange {
+	if c == nil || req.Method != "GET" || req.HasBody() ||
+		req.Headers.Has("range") {
+		return nil
+	}
+	x := &cacheExchange{
+		cache:       c,
+		req:         req,
+		key:         cacheKey(req),
+		cc:          parseCacheControl(req.Headers.Joined("cache-control")),
+		requestTime: time.Now(),
+	}
+	if hasToken(req.Headers.Joined("pragma"), "no-cache") {
+		x.cc["no-cache"] = ""
+	}
+	x.entry = c.store.lookup(x.key, req)
+	return x
+}
+
+// invalidate removes the response to GET for the URI of req, which has
+// been changed by an unsafe method.
+func (c *Cache) invalidate(req *Request) {
+	switch req.Method {
+	case "GET", "HEAD", "OPTIONS", "TRACE", "CONNECT":
+		return
+	}
+	if c != nil {
+		c.store.remove(cacheKey(req))
+	}
+}
+
+// canServe reports whether the entry can be sent without validation.
+func (x *cacheExchange) canServe(now time.Time) bool {
+	if x.entry == nil || x.cc.has("no-cache") {
+		return false
+	}
+	age := x.entry.age(now)
+	lifetime := x.entry.lifetime()
+	if maxAge, ok := x.cc.seconds("max-age"); ok && age > maxAge {
+		return false
+	}
+	if minFresh, ok := x.cc.seconds("min-fresh"); ok {
+		age += minFresh
+	}
+	if age < lifetime {
+		return true
+	}
+	resCC := parseCacheControl(x.entry.Res.Headers.Joined("cache-control"))
+	if !x.cc.has("max-stale") || resCC.has("must-revalidate") ||
+		resCC.has("proxy-revalidate") || resCC.has("no-cache") {
+		return false
+	}
+	maxStale, ok := x.cc.seconds("max-stale")
+	return !ok || age-lifetime <= maxStale
+}
+
+// onlyIfCached reports whether the client doesn't want the request to be
+// sent to the server.
+func (x *cacheExchange) onlyIfCached() bool {
+	return x.cc.has("only-if-cached")
+}
+
+// notModified reports whether a conditional request from the client is
+// satisfied by e, so that 304 can be sent instead.
+func (x *cacheExchange) notModified(e *cacheEntry) bool {
+	h := x.req.Headers
+	etag := e.Res.Headers.Get("etag")
+	if inm := h.Joined("if-none-match"); inm != "" {
+		if etag == "" {
+			return false
+		}
+		for _, t := range strings.Split(inm, ",") {
+			t = strings.TrimSpace(t)
+			if t == "*" || strings.TrimPrefix(t, "W/") ==
+				strings.TrimPrefix(etag, "W/") {
+				return true
+			}
+		}
+		return false
+	}
+	ims, ok := parseHTTPTime(h.Get("if-modified-since"))
+	if !ok {
+		return false
+	}
+	lm, ok := parseHTTPTime(e.Res.Headers.Get("last-modified"))
+	return ok && !lm.After(ims)
+}
+
+// notModifiedResponse returns a 304 response for the entry.
+func notModifiedResponse(res *Response) *Response {
+	nm := *res
+	nm.Status = 304
+	nm.Phrase = "Not Modified"
+	nm.Headers = res.Headers.Clone()
+	nm.Headers.Del("content-length")
+	nm.Headers.Del("transfer-encoding")
+	return &nm
+}
+
+// addConditionals makes out conditional on the stored entry, unless the
+// client has its own conditions.
+func (x *cacheExchange) addConditionals(out *Request) {
+	if x.entry == nil || out.Headers.Has("if-none-match") ||
+		out.Headers.Has("if-modified-since") {
+		return
+	}
+	if etag := x.entry.Res.Headers.Get("etag"); etag != "" {
+		out.Headers.Set("If-None-Match", etag)
+		x.validating = true
+	}
+	if lm := x.entry.Res.Headers.Get("last-modified"); lm != "" {
+		out.Headers.Set("If-Modified-Since", lm)
+		x.validating = true
+	}
+}
+
+// storable reports whether res can be stored for the request.
+func (x *cacheExchange) storable(res *Response) bool {
+	cc := parseCacheControl(res.Headers.Joined("cache-control"))
+	if !cacheableStatus[res.Status] || x.cc.has("no-store") ||
+		cc.has("no-store") || cc.has("private") {
+		return false
+	}
+	// Shared caches only store authenticated responses explicitly allowed
+	if x.req.Headers.Has("authorization") && !cc.has("public") &&
+		!cc.has("s-maxage") && !cc.has("must-revalidate") {
+		return false
+	}
+	// Cookies for a client aren't shared with others
+	if res.Headers.Has("set-cookie") || res.Headers.Get("vary") == "*" {
+		return false
+	}
+	if length, err := parseContentLength(res.Headers); err != nil ||
+		length > x.cache.maxObjectSize {
+		return false
+	}
+	// There's no point in storing what's neither fresh nor revalidatable
+	e := &cacheEntry{Res: res, ResponseTime: time.Now()}
+	return e.lifetime() > 0 || res.Headers.Has("etag") ||
+		res.Headers.Has("last-modified")
+}
+
+// handleResponse is called with the response header from the server. It
+// returns the stored entry to send instead if the server has validated it.
+func (x *cacheExchange) handleResponse(res *Response) *cacheEntry {
+	now := time.Now()
+	if x.validating && res.Status == 304 {
+		e := x.entry.revalidated(res, x.requestTime, now)
+		x.cache.store.update(x.entry, e)
+		return e
+	}
+	if !x.storable(res) {
+		return nil
+	}
+	stored := *res
+	stored.Headers = res.Headers.Clone()
+	if !stored.Headers.Has("date") {
+		stored.Headers.Add("Date", formatHTTPTime(now))
+	}
+	e := &cacheEntry{
+		Key:          x.key,
+		Res:          &stored,
+		Vary:         map[string]string{},
+		RequestTime:  x.requestTime,
+		ResponseTime: now,
+	}
+	for _, name := range strings.Split(res.Headers.Joined("vary"), ",") {
+		if name = strings.ToLower(strings.TrimSpace(name)); name != "" {
+			e.Vary[name] = x.req.Headers.Joined(name)
+		}
+	}
+	w, err := x.cache.store.create(e)
+	if err != nil {
+		return nil
+	}
+	x.w = w
+	return nil
+}
+
+// writeBody stores a piece of the response body.
+func (x *cacheExchange) writeBody(b []byte, isEnd bool) {
+	if x.w == nil {
+		return
+	}
+	x.written += int64(len(b))
+	if x.written > x.cache.maxObjectSize {
+		x.w.abort()
+		x.w = nil
+		return
+	}
+	if _, err := x.w.Write(b); err != nil {
+		x.w.abort()
+		x.w = nil
+		return
+	}
+	if isEnd {
+		if err := x.w.commit(); err != nil {
+			log.Println(err)
+		}
+		x.w = nil
+	}
+}
+
+// finish discards the response being stored if it hasn't been completed.
+func (x *cacheExchange) finish() {
+	if x.w != nil {
+		x.w.abort()
+		x.w = nil
+	}
+}
+
+// readEntryBody sends the body of e as messages.
+func (c *Cache) readEntryBody(e *cacheEntry, emit func([]byte, bool)) error {
+	r, err := c.store.open(e)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	for {
+		b := make([]byte, 32*1024)
+		n, err := r.Read(b)
+		if n > 0 {
+			emit(b[:n], false)
+		}
+		if err == io.EOF {
+			emit(nil, true)
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("Failed to read cached body: %w", err)
+		}
+	}
+}
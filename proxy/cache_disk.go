@@ -0,0 +1,318 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// diskStore keeps entries in a directory so that they survive restarts:
+//
+//	bodies/<sha256>      bodies named by the hash of their content
+//	index/<sha256>.json  entries named by the hash of their key and Vary
+//	tmp/                 files being written
+//
+// Files are written in tmp and renamed into place, so that a crash leaves
+// only files in tmp and bodies without entries, which are removed on start.
+type diskStore struct {
+	dir string
+
+	mu sync.Mutex
+	ix *cacheIndex
+	// Numbers of entries sharing each body
+	refs map[string]int
+}
+
+// The index file of an entry
+type diskEntry struct {
+	Entry *cacheEntry
+	Body  string
+}
+
+func newDiskStore(dir string, maxSize int64) (*diskStore, error) {
+	s := &diskStore{
+		dir:  dir,
+		ix:   newCacheIndex(maxSize),
+		refs: make(map[string]int),
+	}
+	for _, sub := range []string{"bodies", "index", "tmp"} {
+		if err := os.MkdirAll(s.path(sub), 0755); err != nil {
+			return nil, fmt.Errorf("Failed to create cache directory: %w", err)
+		}
+	}
+	if err := s.recover(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *diskStore) path(elem ...string) string {
+	return filepath.Join(append([]string{s.dir}, elem...)...)
+}
+
+// entryID identifies the entry with the key and Vary of e.
+func entryID(e *cacheEntry) string {
+	h := sha256.New()
+	io.WriteString(h, e.Key)
+	var names []string
+	for name := range e.Vary {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(h, "\n%s: %s", name, e.Vary[name])
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// readEntry reads an index file, checking that its body is complete.
+func (s *diskStore) readEntry(name string) (*cacheEntry, error) {
+	b, err := os.ReadFile(s.path("index", name))
+	if err != nil {
+		return nil, err
+	}
+	var de diskEntry
+	if err := json.Unmarshal(b, &de); err != nil {
+		return nil, err
+	}
+	e := de.Entry
+	if e == nil || e.Res == nil || name != entryID(e)+".json" {
+		return nil, fmt.Errorf("Invalid cache entry")
+	}
+	e.bodyID = de.Body
+	fi, err := os.Stat(s.path("bodies", e.bodyID))
+	if err != nil {
+		return nil, err
+	}
+	if fi.Size() != e.BodySize {
+		return nil, fmt.Errorf("Incomplete cached body: %s", e.bodyID)
+	}
+	return e, nil
+}
+
+// recover loads the entries stored by the last run, and removes whatever
+// it left incomplete.
+func (s *diskStore) recover() error {
+	tmps, err := os.ReadDir(s.path("tmp"))
+	if err != nil {
+		return fmt.Errorf("Failed to read cache directory: %w", err)
+	}
+	for _, f := range tmps {
+		os.Remove(s.path("tmp", f.Name()))
+	}
+
+	files, err := os.ReadDir(s.path("index"))
+	if err != nil {
+		return fmt.Errorf("Failed to read cache directory: %w", err)
+	}
+	var entries []*cacheEntry
+	for _, f := range files {
+		e, err := s.readEntry(f.Name())
+		if err != nil {
+			log.Printf("removing cache entry %s: %v\n", f.Name(), err)
+			os.Remove(s.path("index", f.Name()))
+			continue
+		}
+		entries = append(entries, e)
+	}
+	// The order of use is lost, and the oldest responses are evicted first
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].ResponseTime.Before(entries[j].ResponseTime)
+	})
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, e := range entries {
+		s.add(e)
+	}
+
+	bodies, err := os.ReadDir(s.path("bodies"))
+	if err != nil {
+		return fmt.Errorf("Failed to read cache directory: %w", err)
+	}
+	for _, f := range bodies {
+		if s.refs[f.Name()] == 0 {
+			os.Remove(s.path("bodies", f.Name()))
+		}
+	}
+	return nil
+}
+
+// writeFile writes a file in tmp and renames it to path.
+func (s *diskStore) writeFile(path string, b []byte) error {
+	f, err := os.CreateTemp(s.path("tmp"), "index-")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(b)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+// writeEntry must be called with s.mu held.
+func (s *diskStore) writeEntry(e *cacheEntry) error {
+	b, err := json.Marshal(diskEntry{e, e.bodyID})
+	if err != nil {
+		return err
+	}
+	err = s.writeFile(s.path("index", entryID(e)+".json"), b)
+	if err != nil {
+		return fmt.Errorf("Failed to write cache entry: %w", err)
+	}
+	return nil
+}
+
+// release removes the files of e no longer used. It must be called with
+// s.mu held.
+func (s *diskStore) release(e *cacheEntry, removeIndex bool) {
+	if removeIndex {
+		os.Remove(s.path("index", entryID(e)+".json"))
+	}
+	s.refs[e.bodyID]--
+	if s.refs[e.bodyID] <= 0 {
+		delete(s.refs, e.bodyID)
+		os.Remove(s.path("bodies", e.bodyID))
+	}
+}
+
+// add indexes e whose files have been written, and removes the files of
+// the entries it replaces or evicts. It must be called with s.mu held.
+func (s *diskStore) add(e *cacheEntry) {
+	s.refs[e.bodyID]++
+	s.releaseAll(e, s.ix.add(e))
+}
+
+// releaseAll must be called with s.mu held.
+func (s *diskStore) releaseAll(e *cacheEntry, removed []*cacheEntry) {
+	id := entryID(e)
+	for _, r := range removed {
+		// The index file of e has replaced that of the same key and Vary
+		s.release(r, r == e || entryID(r) != id)
+	}
+}
+
+func (s *diskStore) lookup(key string, req *Request) *cacheEntry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.ix.lookup(key, req)
+}
+
+func (s *diskStore) open(e *cacheEntry) (io.ReadCloser, error) {
+	// Still readable after removal while open
+	return os.Open(s.path("bodies", e.bodyID))
+}
+
+type diskWriter struct {
+	s *diskStore
+	e *cacheEntry
+	f *os.File
+	h hash.Hash
+	n int64
+}
+
+func (s *diskStore) create(e *cacheEntry) (cacheWriter, error) {
+	if entrySize(e) > s.ix.maxSize {
+		return nil, fmt.Errorf("Too large to be cached: %s", e.Key)
+	}
+	f, err := os.CreateTemp(s.path("tmp"), "body-")
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create cached body: %w", err)
+	}
+	return &diskWriter{s: s, e: e, f: f, h: sha256.New()}, nil
+}
+
+func (w *diskWriter) Write(b []byte) (int, error) {
+	if entrySize(w.e)+w.n+int64(len(b)) > w.s.ix.maxSize {
+		return 0, fmt.Errorf("Too large to be cached: %s", w.e.Key)
+	}
+	n, err := w.f.Write(b)
+	w.h.Write(b[:n])
+	w.n += int64(n)
+	return n, err
+}
+
+func (w *diskWriter) commit() error {
+	err := w.f.Sync()
+	if cerr := w.f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(w.f.Name())
+		return fmt.Errorf("Failed to write cached body: %w", err)
+	}
+	e := w.e.withBodySize(w.n)
+	e.bodyID = hex.EncodeToString(w.h.Sum(nil))
+
+	s := w.s
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	body := s.path("bodies", e.bodyID)
+	if s.refs[e.bodyID] > 0 {
+		// Same content already stored
+		os.Remove(w.f.Name())
+	} else if err := os.Rename(w.f.Name(), body); err != nil {
+		os.Remove(w.f.Name())
+		return fmt.Errorf("Failed to write cached body: %w", err)
+	}
+	if err := s.writeEntry(e); err != nil {
+		if s.refs[e.bodyID] == 0 {
+			os.Remove(body)
+		}
+		return err
+	}
+	s.add(e)
+	return nil
+}
+
+func (w *diskWriter) abort() {
+	w.f.Close()
+	os.Remove(w.f.Name())
+}
+
+func (s *diskStore) update(old, e *cacheEntry) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// old may have been evicted or replaced
+	if !s.ix.has(old) {
+		return
+	}
+	if err := s.writeEntry(e); err != nil {
+		log.Println(err)
+		return
+	}
+	removed, _ := s.ix.replace(old, e)
+	s.releaseAll(e, removed)
+}
+
+func (s *diskStore) remove(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, e := range s.ix.remove(key) {
+		s.release(e, true)
+	}
+}
+
+// String is for logging.
+func (s *diskStore) String() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return fmt.Sprintf("%s: entries=%d size=%d", s.dir, s.ix.lru.Len(), s.ix.size)
+}
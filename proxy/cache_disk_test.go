@@ -0,0 +1,74 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestDiskStore(t *testing.T) {
+	dir := t.TempDir()
+	s, err := newDiskStore(dir, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	put := func(e *cacheEntry, body string) {
+		w, err := s.create(e)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.WriteString(w, body)
+		if err := w.commit(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	put(newTestEntry("a", "ETag", "\"v1\""), "foo")
+	// Same content is stored once
+	put(newTestEntry("b"), "foo")
+	bodies, _ := os.ReadDir(filepath.Join(dir, "bodies"))
+	ExpectEqual(t, "1", strconv.Itoa(len(bodies)))
+
+	// Leftovers of a crash
+	os.WriteFile(filepath.Join(dir, "tmp", "body-1"), []byte("fo"), 0644)
+	os.WriteFile(filepath.Join(dir, "bodies", "orphan"), []byte("x"), 0644)
+	os.WriteFile(filepath.Join(dir, "index", "broken.json"), []byte("{"), 0644)
+
+	s, err = newDiskStore(dir, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := s.lookup("a", &Request{})
+	if e == nil {
+		t.Fatal("Entry wasn't recovered")
+	}
+	ExpectEqual(t, "\"v1\"", e.Res.Headers.Get("etag"))
+	ExpectEqual(t, "3", e.Res.Headers.Get("content-length"))
+	r, err := s.open(e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := io.ReadAll(r)
+	r.Close()
+	ExpectEqual(t, "foo", string(b))
+	for _, sub := range []string{"tmp", "bodies", "index"} {
+		files, _ := os.ReadDir(filepath.Join(dir, sub))
+		for _, f := range files {
+			switch f.Name() {
+			case "body-1", "orphan", "broken.json":
+				t.Errorf("Leftover wasn't removed: %s", f.Name())
+			}
+		}
+	}
+
+	// The body is removed with the last entry using it
+	s.remove("a")
+	if _, err := os.Stat(filepath.Join(dir, "bodies", e.bodyID)); err != nil {
+		t.Errorf("Shared body was removed")
+	}
+	s.remove("b")
+	if _, err := os.Stat(filepath.Join(dir, "bodies", e.bodyID)); err == nil {
+		t.Errorf("Unused body wasn't removed")
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"container/list"
+)
+
+// cacheIndex finds entries by key and Vary, keeping their total size up to
+// maxSize by evicting the least recently used ones. It's used by stores
+// holding their own lock.
+type cacheIndex struct {
+	maxSize int64
+	size    int64
+	// Front is the most recently used
+	lru     *list.List
+	entries map[string][]*list.Element
+}
+
+func newCacheIndex(maxSize int64) *cacheIndex {
+	return &cacheIndex{
+		maxSize: maxSize,
+		lru:     list.New(),
+		entries: make(map[string][]*list.Element),
+	}
+}
+
+// entrySize approximates the space used by e.
+func entrySize(e *cacheEntry) int64 {
+	n := int64(len(e.Key)) + e.BodySize
+	for _, f := range e.Res.Headers {
+		n += int64(len(f.Name) + len(f.Value))
+	}
+	return n
+}
+
+func sameVary(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for name, v := range a {
+		if bv, ok := b[name]; !ok || bv != v {
+			return false
+		}
+	}
+	return true
+}
+
+func (ix *cacheIndex) lookup(key string, req *Request) *cacheEntry {
+	for _, el := range ix.entries[key] {
+		e := el.Value.(*cacheEntry)
+		if e.matches(req) {
+			ix.lru.MoveToFront(el)
+			return e
+		}
+	}
+	return nil
+}
+
+func (ix *cacheIndex) removeElement(el *list.Element) *cacheEntry {
+	e := el.Value.(*cacheEntry)
+	els := ix.entries[e.Key]
+	for i, v := range els {
+		if v == el {
+			els = append(els[:i:i], els[i+1:]...)
+			break
+		}
+	}
+	if len(els) == 0 {
+		delete(ix.entries, e.Key)
+	} else {
+		ix.entries[e.Key] = els
+	}
+	ix.lru.Remove(el)
+	ix.size -= entrySize(e)
+	return e
+}
+
+// add adds e as the most recently used, and returns the entries removed
+// for it, including the one with the same key and Vary.
+func (ix *cacheIndex) add(e *cacheEntry) []*cacheEntry {
+	var removed []*cacheEntry
+	for _, el := range ix.entries[e.Key] {
+		if sameVary(el.Value.(*cacheEntry).Vary, e.Vary) {
+			removed = append(removed, ix.removeElement(el))
+			break
+		}
+	}
+	ix.entries[e.Key] = append(ix.entries[e.Key], ix.lru.PushFront(e))
+	ix.size += entrySize(e)
+	for ix.size > ix.maxSize {
+		removed = append(removed, ix.removeElement(ix.lru.Back()))
+	}
+	return removed
+}
+
+func (ix *cacheIndex) has(e *cacheEntry) bool {
+	for _, el := range ix.entries[e.Key] {
+		if el.Value.(*cacheEntry) == e {
+			return true
+		}
+	}
+	return false
+}
+
+// replace replaces old with e, and returns the entries evicted for it. It
+// does nothing and returns false if old isn't there.
+func (ix *cacheIndex) replace(old, e *cacheEntry) ([]*cacheEntry, bool) {
+	for _, el := range ix.entries[old.Key] {
+		if el.Value.(*cacheEntry) == old {
+			ix.removeElement(el)
+			return ix.add(e), true
+		}
+	}
+	return nil, false
+}
+
+// remove removes and returns all the entries for key.
+func (ix *cacheIndex) remove(key string) []*cacheEntry {
+	var removed []*cacheEntry
+	for len(ix.entries[key]) > 0 {
+		removed = append(removed, ix.removeElement(ix.entries[key][0]))
+	}
+	return removed
+}
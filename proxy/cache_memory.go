@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// memoryStore keeps entries in memory up to maxSize bytes, evicting the
+// least recently used ones.
+type memoryStore struct {
+	mu sync.Mutex
+	ix *cacheIndex
+}
+
+func newMemoryStore(maxSize int64) *memoryStore {
+	return &memoryStore{ix: newCacheIndex(maxSize)}
+}
+
+func (s *memoryStore) lookup(key string, req *Request) *cacheEntry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.ix.lookup(key, req)
+}
+
+func (s *memoryStore) open(e *cacheEntry) (io.ReadCloser, error) {
+	return io.NopCloser(bytes.NewReader(e.body)), nil
+}
+
+type memoryWriter struct {
+	s *memoryStore
+	e *cacheEntry
+	b bytes.Buffer
+}
+
+func (s *memoryStore) create(e *cacheEntry) (cacheWriter, error) {
+	if entrySize(e) > s.ix.maxSize {
+		return nil, fmt.Errorf("Too large to be cached: %s", e.Key)
+	}
+	return &memoryWriter{s: s, e: e}, nil
+}
+
+func (w *memoryWriter) Write(b []byte) (int, error) {
+	if entrySize(w.e)+int64(w.b.Len()+len(b)) > w.s.ix.maxSize {
+		return 0, fmt.Errorf("Too large to be cached: %s", w.e.Key)
+	}
+	return w.b.Write(b)
+}
+
+func (w *memoryWriter) commit() error {
+	e := w.e.withBodySize(int64(w.b.Len()))
+	e.body = w.b.Bytes()
+	w.s.mu.Lock()
+	w.s.ix.add(e)
+	w.s.mu.Unlock()
+	return nil
+}
+
+func (w *memoryWriter) abort() {}
+
+func (s *memoryStore) update(old, e *cacheEntry) {
+	s.mu.Lock()
+	s.ix.replace(old, e)
+	s.mu.Unlock()
+}
+
+func (s *memoryStore) remove(key string) {
+	s.mu.Lock()
+	s.ix.remove(key)
+	s.mu.Unlock()
+}
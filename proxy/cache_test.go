@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestEntry(key string, headers ...string) *cacheEntry {
+	res := &Response{Version: "HTTP/1.1", Status: 200, Phrase: "OK"}
+	for i := 0; i < len(headers); i += 2 {
+		res.Headers.Add(headers[i], headers[i+1])
+	}
+	now := time.Now()
+	return &cacheEntry{
+		Key: key, Res: res, Vary: map[string]string{},
+		RequestTime: now, ResponseTime: now,
+	}
+}
+
+func TestCacheEntryLifetime(t *testing.T) {
+	now := time.Now()
+	date := formatHTTPTime(now)
+	ExpectEqual(t, "1m0s",
+		newTestEntry("a", "Cache-Control", "max-age=60").lifetime().String())
+	ExpectEqual(t, "30s", newTestEntry("a",
+		"Cache-Control", "max-age=60, s-maxage=30").lifetime().String())
+	ExpectEqual(t, "0s", newTestEntry("a",
+		"Cache-Control", "no-cache, max-age=60").lifetime().String())
+	ExpectEqual(t, "1h0m0s", newTestEntry("a", "Date", date,
+		"Expires", formatHTTPTime(now.Add(time.Hour))).lifetime().String())
+	ExpectEqual(t, "0s",
+		newTestEntry("a", "Date", date, "Expires", "0").lifetime().String())
+	ExpectEqual(t, "1h0m0s", newTestEntry("a", "Date", date,
+		"Last-Modified", formatHTTPTime(now.Add(-10*time.Hour))).
+		lifetime().String())
+
+	e := newTestEntry("a", "Date", date, "Age", "100")
+	age := e.age(now.Add(10 * time.Second))
+	if age < 109*time.Second || age > 111*time.Second {
+		t.Errorf("Unexpected age: %v", age)
+	}
+}
+
+func TestMemoryStore(t *testing.T) {
+	s := newMemoryStore(200)
+	put := func(e *cacheEntry, body string) {
+		w, err := s.create(e)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.WriteString(w, body)
+		w.commit()
+	}
+	req := &Request{Method: "GET", URI: "/"}
+	req.Headers.Add("Accept-Language", "ja")
+
+	en := newTestEntry("a")
+	en.Vary["accept-language"] = "en"
+	put(en, "hello")
+	ja := newTestEntry("a")
+	ja.Vary["accept-language"] = "ja"
+	put(ja, "konnichiwa")
+	e := s.lookup("a", req)
+	if e == nil {
+		t.Fatal("Variant not found")
+	}
+	ExpectEqual(t, "10", e.Res.Headers.Get("content-length"))
+	r, _ := s.open(e)
+	b, _ := io.ReadAll(r)
+	ExpectEqual(t, "konnichiwa", string(b))
+
+	// "a" is evicted for the least recently used variant
+	put(newTestEntry("b"), strings.Repeat("x", 150))
+	if s.lookup("a", req) == nil {
+		t.Errorf("Recently used entry was evicted")
+	}
+	req.Headers.Set("Accept-Language", "en")
+	if s.lookup("a", req) != nil {
+		t.Errorf("Least recently used entry wasn't evicted")
+	}
+
+	s.remove("a")
+	if s.lookup("a", &Request{}) != nil {
+		t.Errorf("Removed entry was found")
+	}
+}
+
+// readTestResponse reads a response having Content-Length.
+func readTestResponse(t *testing.T, r *bufio.Reader) (string, string) {
+	status, err := r.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	length := 0
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			break
+		}
+		if v, ok := strings.CutPrefix(line, "Content-Length: "); ok {
+			length, _ = strconv.Atoi(v)
+		}
+	}
+	b := make([]byte, length)
+	if _, err := io.ReadFull(r, b); err != nil {
+		t.Fatal(err)
+	}
+	return strings.TrimSpace(status), string(b)
+}
+
+func TestCacheThroughProxy(t *testing.T) {
+	responseCache = NewCache(newMemoryStore(1<<20), 1<<20)
+	defer func() { responseCache = nil }()
+
+	// Origin answering If-None-Match with 304
+	ln, accepted := listen(t)
+	defer ln.Close()
+	requests := make(chan string, 10)
+	go func() {
+		for conn := range accepted {
+			go func(conn net.Conn) {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				for {
+					inm := ""
+					for {
+						line, err := r.ReadString('\n')
+						if err != nil {
+							return
+						}
+						line = strings.TrimSpace(line)
+						if line == "" {
+							break
+						}
+						if v, ok := strings.CutPrefix(line, "If-None-Match: "); ok {
+							inm = v
+						}
+					}
+					requests <- inm
+					if inm == "\"v1\"" {
+						io.WriteString(conn, "HTTP/1.1 304 Not Modified\r\n"+
+							"ETag: \"v1\"\r\n\r\n")
+						continue
+					}
+					io.WriteString(conn, "HTTP/1.1 200 OK\r\n"+
+						"Cache-Control: max-age=60\r\nETag: \"v1\"\r\n"+
+						"Content-Length: 3\r\n\r\nfoo")
+				}
+			}(conn)
+		}
+	}()
+
+	conn, peer := net.Pipe()
+	go handle(conn)
+	defer peer.Close()
+	r := bufio.NewReader(peer)
+	get := func(headers string) (string, string) {
+		go fmt.Fprintf(peer, "GET http://%s/ HTTP/1.1\r\n%s\r\n",
+			ln.Addr().String(), headers)
+		return readTestResponse(t, r)
+	}
+
+	status, body := get("")
+	ExpectEqual(t, "HTTP/1.1 200 OK", status)
+	ExpectEqual(t, "foo", body)
+	ExpectEqual(t, "", <-requests)
+
+	// Served from the cache
+	status, body = get("")
+	ExpectEqual(t, "HTTP/1.1 200 OK", status)
+	ExpectEqual(t, "foo", body)
+	status, _ = get("If-None-Match: \"v1\"\r\n")
+	ExpectEqual(t, "HTTP/1.1 304 Not Modified", status)
+
+	// Revalidated
+	status, body = get("Cache-Control: no-cache\r\n")
+	ExpectEqual(t, "HTTP/1.1 200 OK", status)
+	ExpectEqual(t, "foo", body)
+	ExpectEqual(t, "\"v1\"", <-requests)
+	select {
+	case inm := <-requests:
+		t.Errorf("Unexpected request: %q", inm)
+	default:
+	}
+}
@@ -0,0 +1,445 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"reflect"
+	"sync/atomic"
+	"time"
+)
+
+// Config is the configuration read from a JSON file, like:
+//
+//	{
+//	  "listen": ":8080",
+//	  "timeouts": {"dial": "10s", "header": "30s"},
+//	  "access_log": {"path": "/var/log/proxy/access.log", "format": "json"},
+//	  "limits": {"rate": 10, "burst": 20}
+//	}
+//
+// Omitted fields have the default values, and command-line flags override
+// the file. Listen, AdminListen, ShutdownTimeout, Cache, Pool, HAR and
+// Fixtures are only read at start, while the others are reloaded on SIGHUP.
+type Config struct {
+	Listen string `json:"listen"`
+	// Address serving /metrics, or "" if not used
+	AdminListen     string           `json:"admin_listen"`
+	ShutdownTimeout Duration         `json:"shutdown_timeout"`
+	Timeouts        TimeoutsConfig   `json:"timeouts"`
+	Forwarding      ForwardingConfig `json:"forwarding"`
+	Cache           CacheConfig      `json:"cache"`
+	Pool            PoolConfig       `json:"pool"`
+	AccessLog       AccessLogConfig  `json:"access_log"`
+	// Files of ACL rules, htpasswd and upstream rules, or "" if not used
+	ACL           string `json:"acl"`
+	Htpasswd      string `json:"htpasswd"`
+	AuthRealm     string `json:"auth_realm"`
+	UpstreamRules string `json:"upstream_rules"`
+	Limits        Limits `json:"limits"`
+	// Run in order on requests, and in reverse on responses
+	Middleware []MiddlewareConfig `json:"middleware"`
+	HAR        HARConfig          `json:"har"`
+	Fixtures   FixturesConfig     `json:"fixtures"`
+	// Routing table of the reverse proxy, or empty to only forward
+	Routes []RouteConfig `json:"routes"`
+	// Whether requests in absolute form without a route, and CONNECT, are
+	// still forwarded when Routes is given
+	ForwardProxy bool `json:"forward_proxy"`
+}
+
+// Duration is a time.Duration written like "1m30s" in JSON.
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("Duration must be a string like \"10s\"")
+	}
+	return d.Set(s)
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+// String and Set make Duration a flag.Value.
+func (d *Duration) String() string {
+	return time.Duration(*d).String()
+}
+
+func (d *Duration) Set(s string) error {
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+type TimeoutsConfig struct {
+	Dial      Duration `json:"dial"`
+	Header    Duration `json:"header"`
+	BodyIdle  Duration `json:"body_idle"`
+	Request   Duration `json:"request"`
+	KeepAlive Duration `json:"keep_alive"`
+}
+
+type CacheConfig struct {
+	// Bytes of responses cached, or 0 to disable the cache
+	Size      int64  `json:"size"`
+	MaxObject int64  `json:"max_object"`
+	Dir       string `json:"dir"`
+}
+
+type PoolConfig struct {
+	MaxIdlePerHost int      `json:"max_idle_per_host"`
+	IdleTimeout    Duration `json:"idle_timeout"`
+}
+
+type AccessLogConfig struct {
+	Path   string `json:"path"`
+	Format string `json:"format"`
+}
+
+func defaultConfig() *Config {
+	return &Config{
+		Listen:          ":8080",
+		ShutdownTimeout: Duration(30 * time.Second),
+		Timeouts: TimeoutsConfig{
+			Dial:      Duration(10 * time.Second),
+			Header:    Duration(30 * time.Second),
+			BodyIdle:  Duration(60 * time.Second),
+			Request:   Duration(10 * time.Minute),
+			KeepAlive: Duration(15 * time.Second),
+		},
+		Forwarding: ForwardingConfig{
+			Via:           true,
+			ViaName:       "go-proxy",
+			XForwardedFor: true,
+		},
+		Cache: CacheConfig{Size: 64 << 20, MaxObject: 8 << 20},
+		Pool: PoolConfig{
+			MaxIdlePerHost: 4,
+			IdleTimeout:    Duration(90 * time.Second),
+		},
+		AccessLog: AccessLogConfig{Format: LogCombined},
+		AuthRealm: "proxy",
+		HAR:       HARConfig{MaxBody: 64 << 10, MaxEntries: 1000},
+		Fixtures:  FixturesConfig{MaxBody: 16 << 20},
+		Limits:    Limits{Burst: 10},
+	}
+}
+
+// defineFlags defines the flags overriding the fields of c.
+func defineFlags(fs *flag.FlagSet, c *Config) {
+	fs.StringVar(&c.Listen, "listen", c.Listen, "address to listen on")
+	fs.StringVar(&c.AdminListen, "admin-listen", c.AdminListen,
+		"address serving /metrics, or empty to disable")
+	fs.Var(&c.ShutdownTimeout, "shutdown-timeout",
+		"time to let requests finish on SIGTERM or SIGINT")
+
+	fs.Var(&c.Timeouts.Dial, "dial-timeout", "timeout of connecting to servers")
+	fs.Var(&c.Timeouts.Header, "header-timeout",
+		"timeout of receiving a request or response header")
+	fs.Var(&c.Timeouts.BodyIdle, "body-idle-timeout",
+		"timeout of receiving each part of a body")
+	fs.Var(&c.Timeouts.Request, "request-timeout",
+		"timeout of a whole request and response")
+	fs.Var(&c.Timeouts.KeepAlive, "keep-alive-timeout",
+		"time an idle client connection is kept")
+
+	fs.BoolVar(&c.Forwarding.Via, "via", c.Forwarding.Via,
+		"add Via to requests and responses")
+	fs.StringVar(&c.Forwarding.ViaName, "via-name", c.Forwarding.ViaName,
+		"name of the proxy in Via")
+	fs.BoolVar(&c.Forwarding.XForwardedFor, "x-forwarded-for",
+		c.Forwarding.XForwardedFor, "add X-Forwarded-For to requests")
+	fs.BoolVar(&c.Forwarding.Forwarded, "forwarded", c.Forwarding.Forwarded,
+		"add Forwarded to requests")
+
+	fs.Int64Var(&c.Cache.Size, "cache-size", c.Cache.Size,
+		"bytes of responses cached, or 0 to disable the cache")
+	fs.Int64Var(&c.Cache.MaxObject, "cache-max-object", c.Cache.MaxObject,
+		"bytes of the largest response cached")
+	fs.StringVar(&c.Cache.Dir, "cache-dir", c.Cache.Dir,
+		"directory to keep the cache in instead of memory")
+
+	fs.StringVar(&c.AccessLog.Path, "access-log", c.AccessLog.Path,
+		"file to write the access log to, or - for stdout")
+	fs.StringVar(&c.AccessLog.Format, "access-log-format", c.AccessLog.Format,
+		"format of the access log: common, combined or json")
+
+	fs.StringVar(&c.ACL, "acl", c.ACL,
+		"file of rules allowing and denying requests")
+	fs.StringVar(&c.Htpasswd, "htpasswd", c.Htpasswd,
+		"htpasswd file of users required to authenticate")
+	fs.StringVar(&c.AuthRealm, "auth-realm", c.AuthRealm,
+		"realm in Proxy-Authenticate")
+	fs.StringVar(&c.UpstreamRules, "upstream-rules", c.UpstreamRules,
+		"file of rules choosing parent proxies by destination host")
+
+	fs.StringVar(&c.HAR.Path, "har", c.HAR.Path,
+		"HAR file to record requests and responses to")
+
+	fs.StringVar(&c.Fixtures.Mode, "fixtures-mode", c.Fixtures.Mode,
+		"record to record responses to -fixtures-dir, or replay to serve them")
+	fs.StringVar(&c.Fixtures.Dir, "fixtures-dir", c.Fixtures.Dir,
+		"directory of recorded responses")
+
+	fs.Float64Var(&c.Limits.Rate, "rate", c.Limits.Rate,
+		"requests per second from each client IP, or 0 for unlimited")
+	fs.IntVar(&c.Limits.Burst, "burst", c.Limits.Burst,
+		"requests from each client IP allowed in a burst over -rate")
+	fs.IntVar(&c.Limits.MaxConnsPerClient, "max-conns-per-client",
+		c.Limits.MaxConnsPerClient,
+		"concurrent connections from each client IP, or 0 for unlimited")
+	fs.IntVar(&c.Limits.MaxConns, "max-conns", c.Limits.MaxConns,
+		"concurrent connections in total, or 0 for unlimited")
+}
+
+// loadConfig reads the file at path over the defaults, unless path is "",
+// and applies the flags set in cmdline.
+func loadConfig(path string, cmdline *flag.FlagSet) (*Config, error) {
+	c := defaultConfig()
+	if path != "" {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read config: %w", err)
+		}
+		dec := json.NewDecoder(bytes.NewReader(b))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(c); err != nil {
+			return nil, fmt.Errorf("Failed to read config %s: %w", path, err)
+		}
+	}
+
+	fs := flag.NewFlagSet("", flag.ContinueOnError)
+	defineFlags(fs, c)
+	var err error
+	cmdline.Visit(func(f *flag.Flag) {
+		if fs.Lookup(f.Name) != nil && err == nil {
+			err = fs.Set(f.Name, f.Value.String())
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := c.validate(); err != nil {
+		return nil, fmt.Errorf("Invalid config: %w", err)
+	}
+	return c, nil
+}
+
+// validate returns all the errors found in c.
+func (c *Config) validate() error {
+	var errs []error
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+	_, _, err := net.SplitHostPort(c.Listen)
+	check(err == nil, "listen: %v", err)
+	if c.AdminListen != "" {
+		_, _, err := net.SplitHostPort(c.AdminListen)
+		check(err == nil, "admin_listen: %v", err)
+		check(c.AdminListen != c.Listen, "admin_listen: same as listen")
+	}
+	check(c.ShutdownTimeout >= 0, "shutdown_timeout: must not be negative")
+	t := c.Timeouts
+	for i, d := range []Duration{
+		t.Dial, t.Header, t.BodyIdle, t.Request, t.KeepAlive,
+	} {
+		name := []string{"dial", "header", "body_idle", "request", "keep_alive"}[i]
+		check(d >= 0, "timeouts.%s: must not be negative", name)
+	}
+	check(!c.Forwarding.Via || c.Forwarding.ViaName != "",
+		"forwarding.via_name: must be given with via")
+	check(c.Cache.Size >= 0, "cache.size: must not be negative")
+	check(c.Cache.Size == 0 || c.Cache.MaxObject > 0,
+		"cache.max_object: must be positive")
+	check(c.Pool.MaxIdlePerHost >= 0,
+		"pool.max_idle_per_host: must not be negative")
+	check(c.Pool.IdleTimeout > 0, "pool.idle_timeout: must be positive")
+	switch c.AccessLog.Format {
+	case LogCommon, LogCombined, LogJSON:
+	default:
+		check(false, "access_log.format: unknown format %q", c.AccessLog.Format)
+	}
+	check(c.AuthRealm != "" || c.Htpasswd == "",
+		"auth_realm: must be given with htpasswd")
+	check(c.Limits.Rate >= 0, "limits.rate: must not be negative")
+	check(c.Limits.Burst >= 0, "limits.burst: must not be negative")
+	check(c.Limits.MaxConnsPerClient >= 0,
+		"limits.max_conns_per_client: must not be negative")
+	check(c.Limits.MaxConns >= 0, "limits.max_conns: must not be negative")
+	if err := c.HAR.validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := c.Fixtures.validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if _, err := NewRoutes(c.Routes); err != nil {
+		errs = append(errs, err)
+	}
+	for i, m := range c.Middleware {
+		_, ok := middlewareFactories[m.Name]
+		check(ok, "middleware[%d]: unknown name %q", i, m.Name)
+	}
+	return errors.Join(errs...)
+}
+
+func (c *Config) timeouts() Timeouts {
+	return Timeouts{
+		Dial:      time.Duration(c.Timeouts.Dial),
+		Header:    time.Duration(c.Timeouts.Header),
+		BodyIdle:  time.Duration(c.Timeouts.BodyIdle),
+		Request:   time.Duration(c.Timeouts.Request),
+		KeepAlive: time.Duration(c.Timeouts.KeepAlive),
+	}
+}
+
+// settings are what's reloaded while running. They aren't modified once
+// made current, and a request uses those current when it started.
+type settings struct {
+	timeouts   Timeouts
+	forwarding ForwardingConfig
+	// nil if not used
+	acl       *ACL
+	auth      *Htpasswd
+	authRealm string
+	upstream  *UpstreamRules
+	routes    *Routes
+	// Whether to forward requests without a route when routes isn't nil
+	forwardProxy bool
+	accessLog    *AccessLog
+	// Empty if not used
+	middleware middlewareChain
+	// Made at start and kept by reloads, nil if not used
+	har      *HARRecorder
+	fixtures *FixtureStore
+	// Files the above were loaded from
+	config *Config
+}
+
+var current atomic.Pointer[settings]
+
+func init() {
+	st, _ := newSettings(defaultConfig(), nil)
+	current.Store(st)
+}
+
+func loadSettings() *settings {
+	return current.Load()
+}
+
+// newSettings loads the files in c. The access log of prev is reused if
+// it's the same one.
+func newSettings(c *Config, prev *settings) (*settings, error) {
+	st := &settings{
+		timeouts:     c.timeouts(),
+		forwarding:   c.Forwarding,
+		authRealm:    c.AuthRealm,
+		forwardProxy: c.ForwardProxy,
+		config:       c,
+	}
+	if prev != nil {
+		st.har = prev.har
+		st.fixtures = prev.fixtures
+	}
+	var err error
+	if st.middleware, err = newMiddlewareChain(c.Middleware); err != nil {
+		return nil, err
+	}
+	// Unchanged routes are kept, so that their backends stay ejected or
+	// down, as a reload is also made to rotate the access log
+	if prev != nil && prev.routes != nil &&
+		reflect.DeepEqual(prev.config.Routes, c.Routes) {
+		st.routes = prev.routes
+	} else if st.routes, err = NewRoutes(c.Routes); err != nil {
+		return nil, err
+	}
+	if c.ACL != "" {
+		if st.acl, err = LoadACL(c.ACL); err != nil {
+			return nil, err
+		}
+	}
+	if c.Htpasswd != "" {
+		if st.auth, err = LoadHtpasswd(c.Htpasswd); err != nil {
+			return nil, err
+		}
+	}
+	if c.UpstreamRules != "" {
+		if st.upstream, err = LoadUpstreamRules(c.UpstreamRules); err != nil {
+			return nil, err
+		}
+	}
+	if c.AccessLog.Path != "" {
+		if prev != nil && prev.accessLog != nil &&
+			prev.config.AccessLog == c.AccessLog {
+			st.accessLog = prev.accessLog
+		} else if st.accessLog, err = NewAccessLog(
+			c.AccessLog.Path, c.AccessLog.Format); err != nil {
+			return nil, err
+		}
+	}
+	return st, nil
+}
+
+// applySettings makes st current.
+func applySettings(st *settings) {
+	st.routes.start()
+	prev := current.Swap(st)
+	if prev != nil && prev.routes != st.routes {
+		prev.routes.stop()
+	}
+	limiter.SetLimits(st.config.Limits)
+	if prev != nil && prev.accessLog != nil && prev.accessLog != st.accessLog {
+		prev.accessLog.Close()
+	}
+}
+
+// reload reads the config again on SIGHUP, reopens the access log so that
+// it can be rotated, and writes the HAR file. Settings only read at start
+// are left as they are.
+func reload(path string, cmdline *flag.FlagSet) {
+	// Even if the config is broken, the log isn't kept on a rotated file
+	prev := loadSettings()
+	if prev.accessLog != nil {
+		if err := prev.accessLog.Reopen(); err != nil {
+			log.Println(err)
+		}
+	}
+	if prev.har != nil {
+		if err := prev.har.Flush(); err != nil {
+			log.Println(err)
+		}
+	}
+	c, err := loadConfig(path, cmdline)
+	if err != nil {
+		log.Printf("config not reloaded: %v\n", err)
+		return
+	}
+	st, err := newSettings(c, prev)
+	if err != nil {
+		log.Printf("config not reloaded: %v\n", err)
+		return
+	}
+	pc := prev.config
+	if c.Listen != pc.Listen || c.AdminListen != pc.AdminListen ||
+		c.ShutdownTimeout != pc.ShutdownTimeout ||
+		c.Cache != pc.Cache || c.Pool != pc.Pool ||
+		!reflect.DeepEqual(c.HAR, pc.HAR) ||
+		!reflect.DeepEqual(c.Fixtures, pc.Fixtures) {
+		log.Println("listen, admin_listen, shutdown_timeout, cache, pool, " +
+			"har and fixtures need a restart")
+	}
+	applySettings(st)
+	log.Println("config reloaded")
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// withSettings makes the current settings modified by f current during
+// the test.
+func withSettings(t *testing.T, f func(st *settings)) {
+	prev := loadSettings()
+	st := *prev
+	f(&st)
+	current.Store(&st)
+	t.Cleanup(func() { current.Store(prev) })
+}
+
+func writeTestConfig(t *testing.T, config string) string {
+	path := filepath.Join(t.TempDir(), "proxy.json")
+	if err := os.WriteFile(path, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfig(t *testing.T) {
+	path := writeTestConfig(t, `{
+  "listen": "127.0.0.1:3128",
+  "timeouts": {"dial": "5s", "keep_alive": "1m"},
+  "forwarding": {"via": true, "via_name": "edge"},
+  "limits": {"rate": 2.5, "burst": 5}
+}`)
+	cmdline := flag.NewFlagSet("", flag.ContinueOnError)
+	defineFlags(cmdline, defaultConfig())
+	if err := cmdline.Parse([]string{"-burst", "20", "-dial-timeout", "3s"}); err != nil {
+		t.Fatal(err)
+	}
+	c, err := loadConfig(path, cmdline)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ExpectEqual(t, "127.0.0.1:3128", c.Listen)
+	// Flags override the file, which overrides the defaults
+	ExpectEqual(t, "3s", c.Timeouts.Dial.String())
+	ExpectEqual(t, "1m0s", c.Timeouts.KeepAlive.String())
+	ExpectEqual(t, "30s", c.Timeouts.Header.String())
+	ExpectEqual(t, "edge", c.Forwarding.ViaName)
+	ExpectEqual(t, "2.5", strconv.FormatFloat(c.Limits.Rate, 'g', -1, 64))
+	ExpectEqual(t, "20", strconv.Itoa(c.Limits.Burst))
+}
+
+func TestConfigValidation(t *testing.T) {
+	cmdline := flag.NewFlagSet("", flag.ContinueOnError)
+	for _, config := range []string{
+		`{"listen": "8080"}`,
+		`{"timeouts": {"dial": "-1s"}}`,
+		`{"timeouts": {"dial": 10}}`,
+		`{"access_log": {"format": "xml"}}`,
+		`{"limits": {"rate": -1}}`,
+		`{"limit": {}}`,
+		`{`,
+	} {
+		if _, err := loadConfig(writeTestConfig(t, config), cmdline); err == nil {
+			t.Errorf("Invalid config was accepted: %s", config)
+		}
+	}
+
+	// Every error is reported
+	_, err := loadConfig(writeTestConfig(t,
+		`{"cache": {"size": -1}, "limits": {"max_conns": -1}}`), cmdline)
+	if err == nil {
+		t.Fatal("Invalid config was accepted")
+	}
+	ExpectEqual(t, "Invalid config: cache.size: must not be negative\n"+
+		"limits.max_conns: must not be negative", err.Error())
+}
+
+func TestReload(t *testing.T) {
+	dir := t.TempDir()
+	harPath := filepath.Join(dir, "proxy.har")
+	har, err := NewHARRecorder(HARConfig{Path: harPath, MaxEntries: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	har.entries = append(har.entries, &harEntry{})
+	withSettings(t, func(st *settings) { st.har = har })
+	acl := filepath.Join(dir, "acl")
+	if err := os.WriteFile(acl, []byte("deny\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	path := writeTestConfig(t, `{"acl": "`+acl+`", "limits": {"rate": 1}}`)
+	cmdline := flag.NewFlagSet("", flag.ContinueOnError)
+	defer limiter.SetLimits(Limits{})
+
+	reload(path, cmdline)
+	st := loadSettings()
+	if st.acl == nil {
+		t.Fatal("ACL wasn't loaded")
+	}
+	ExpectEqual(t, "1", strconv.FormatFloat(limiter.limits.Rate, 'g', -1, 64))
+
+	// A broken config leaves the settings as they are, but the access log
+	// is still reopened
+	logPath := filepath.Join(dir, "access.log")
+	os.WriteFile(path, []byte(`{"access_log": {"path": "`+logPath+`"}}`), 0644)
+	reload(path, cmdline)
+	st = loadSettings()
+	os.Rename(logPath, logPath+".1")
+	os.WriteFile(path, []byte(`{"acl": "`+dir+`/missing"}`), 0644)
+	reload(path, cmdline)
+	if loadSettings() != st {
+		t.Errorf("Settings were replaced by a broken config")
+	}
+	if _, err := os.Stat(logPath); err != nil {
+		t.Errorf("Access log wasn't reopened: %v", err)
+	}
+	// and the HAR file written
+	b, _ := os.ReadFile(harPath)
+	if !strings.Contains(string(b), "startedDateTime") {
+		t.Errorf("HAR file wasn't written: %s", b)
+	}
+
+	// Backends are kept ejected while the routes are unchanged
+	os.WriteFile(path, []byte(`{"routes": [{"backends": ["a:80", "b:80"]}]}`),
+		0644)
+	reload(path, cmdline)
+	a := loadSettings().routes.routes[0].lb.backends[0]
+	a.failed(1, time.Hour)
+	reload(path, cmdline)
+	ExpectEqual(t, "false", strconv.FormatBool(
+		loadSettings().routes.routes[0].lb.backends[0].healthy(time.Now())))
+	os.WriteFile(path, []byte(`{"routes": [{"backends": ["a:80"]}]}`), 0644)
+	reload(path, cmdline)
+	ExpectEqual(t, "true", strconv.FormatBool(
+		loadSettings().routes.routes[0].lb.backends[0].healthy(time.Now())))
+}
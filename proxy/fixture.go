@@ -0,0 +1,289 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Modes of fixtures
+const (
+	FixturesRecord = "record"
+	FixturesReplay = "replay"
+)
+
+// FixturesConfig selects whether responses are recorded to or replayed
+// from files. CONNECT tunnels aren't recorded, and are refused in replay.
+type FixturesConfig struct {
+	// FixturesRecord, FixturesReplay, or "" to do neither
+	Mode string `json:"mode"`
+	Dir  string `json:"dir"`
+	// Request header fields that must match besides the method, URI and
+	// body
+	MatchHeaders []string `json:"match_headers"`
+	// Bytes of the largest response body recorded, as it's kept in memory
+	MaxBody int64 `json:"max_body"`
+}
+
+func (c *FixturesConfig) validate() error {
+	switch c.Mode {
+	case "":
+		return nil
+	case FixturesRecord, FixturesReplay:
+	default:
+		return fmt.Errorf("fixtures.mode: unknown mode %q", c.Mode)
+	}
+	if c.Dir == "" {
+		return fmt.Errorf("fixtures.dir: must be given with mode")
+	}
+	if c.MaxBody <= 0 {
+		return fmt.Errorf("fixtures.max_body: must be positive")
+	}
+	return nil
+}
+
+// A fixtureRequest is what a request is matched on.
+type fixtureRequest struct {
+	Method string `json:"method"`
+	URI    string `json:"uri"`
+	// Values of the match headers, keyed by lower-case names
+	Headers    map[string]string `json:"headers"`
+	BodySHA256 string            `json:"body_sha256"`
+}
+
+// A fixture is a file of a recorded response.
+type fixture struct {
+	Request  fixtureRequest `json:"request"`
+	Response *Response      `json:"response"`
+	Body     []byte         `json:"body"`
+}
+
+// key returns the name of the file of r.
+func (r *fixtureRequest) key() string {
+	names := make([]string, 0, len(r.Headers))
+	for name := range r.Headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\n%s\n", r.Method, r.URI)
+	for _, name := range names {
+		fmt.Fprintf(h, "%s: %s\n", name, r.Headers[name])
+	}
+	fmt.Fprintf(h, "%s\n", r.BodySHA256)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// FixtureStore records responses to files in a directory, or replays them.
+type FixtureStore struct {
+	config FixturesConfig
+}
+
+func NewFixtureStore(config FixturesConfig) (*FixtureStore, error) {
+	if config.Mode == FixturesRecord {
+		if err := os.MkdirAll(config.Dir, 0755); err != nil {
+			return nil, fmt.Errorf("Failed to create fixtures: %w", err)
+		}
+	} else if _, err := os.Stat(config.Dir); err != nil {
+		return nil, fmt.Errorf("Failed to open fixtures: %w", err)
+	}
+	return &FixtureStore{config}, nil
+}
+
+func (s *FixtureStore) replaying() bool {
+	return s != nil && s.config.Mode == FixturesReplay
+}
+
+// matchRequest returns what req is matched on, except the body.
+func (s *FixtureStore) matchRequest(req *Request) fixtureRequest {
+	r := fixtureRequest{
+		Method:  req.Method,
+		URI:     cacheKey(req),
+		Headers: make(map[string]string),
+	}
+	for _, name := range s.config.MatchHeaders {
+		r.Headers[strings.ToLower(name)] = req.Headers.Joined(name)
+	}
+	return r
+}
+
+func (s *FixtureStore) path(key string) string {
+	return filepath.Join(s.config.Dir, key+".json")
+}
+
+// lookup returns the fixture matching r.
+func (s *FixtureStore) lookup(r *fixtureRequest) (*fixture, error) {
+	b, err := os.ReadFile(s.path(r.key()))
+	if err != nil {
+		return nil, err
+	}
+	f := &fixture{}
+	if err := json.Unmarshal(b, f); err != nil {
+		return nil, fmt.Errorf("Broken fixture %s: %w", r.key(), err)
+	}
+	return f, nil
+}
+
+func (s *FixtureStore) save(f *fixture) error {
+	b, err := json.MarshalIndent(f, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(s.config.Dir, ".fixture-")
+	if err != nil {
+		return fmt.Errorf("Failed to save fixture: %w", err)
+	}
+	_, err = tmp.Write(b)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), s.path(f.Request.key()))
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("Failed to save fixture: %w", err)
+	}
+	return nil
+}
+
+// A fixtureRecording records the response to a request forwarded to the
+// server. Its methods do nothing if it's nil.
+type fixtureRecording struct {
+	store   *FixtureStore
+	req     fixtureRequest
+	reqBody hash.Hash
+	// Whether the whole request body has been received
+	reqDone bool
+	res     *Response
+	body    []byte
+}
+
+// record starts recording the response to req, or returns nil if not
+// recording.
+func (s *FixtureStore) record(req *Request) *fixtureRecording {
+	if s == nil || s.config.Mode != FixturesRecord {
+		return nil
+	}
+	return &fixtureRecording{
+		store:   s,
+		req:     s.matchRequest(req),
+		reqBody: sha256.New(),
+		reqDone: !req.HasBody(),
+	}
+}
+
+func (r *fixtureRecording) addRequestBody(b []byte, isEnd bool) {
+	if r != nil {
+		r.reqBody.Write(b)
+		r.reqDone = isEnd
+	}
+}
+
+func (r *fixtureRecording) setResponse(res *Response) {
+	if r != nil {
+		r.res = res
+	}
+}
+
+// addResponseBody saves the fixture at the end of the body.
+func (r *fixtureRecording) addResponseBody(b []byte, isEnd bool) {
+	if r == nil || r.res == nil {
+		return
+	}
+	if int64(len(r.body)+len(b)) > r.store.config.MaxBody {
+		log.Printf("fixture not recorded: body over %d bytes: %s\n",
+			r.store.config.MaxBody, r.req.URI)
+		r.res = nil
+		r.body = nil
+		return
+	}
+	r.body = append(r.body, b...)
+	if !isEnd {
+		return
+	}
+	if !r.reqDone {
+		log.Printf("fixture not recorded: incomplete request body: %s\n",
+			r.req.URI)
+		return
+	}
+	r.req.BodySHA256 = hex.EncodeToString(r.reqBody.Sum(nil))
+	f := &fixture{Request: r.req, Response: r.res, Body: r.body}
+	if err := r.store.save(f); err != nil {
+		log.Println(err)
+		return
+	}
+	log.Printf("fixture recorded: %s %s\n", r.req.Method, r.req.URI)
+}
+
+// response returns the header of f to be sent with its body in one piece.
+func (f *fixture) response() *Response {
+	res := *f.Response
+	res.Headers = f.Response.Headers.Clone()
+	if responseHasBody(f.Request.Method, res.Status) {
+		res.Headers.Del("Transfer-Encoding")
+		res.Headers.Set("Content-Length", strconv.Itoa(len(f.Body)))
+	}
+	return &res
+}
+
+// fixtureMissResponse returns 502 telling that r has no fixture.
+func fixtureMissResponse(r *fixtureRequest, err error) (*Response, []byte) {
+	reason := "No fixture"
+	if !errors.Is(err, fs.ErrNotExist) {
+		reason = err.Error()
+	}
+	body := []byte(fmt.Sprintf("%s for %s %s\nKey: %s\n",
+		reason, r.Method, r.URI, r.key()))
+	res := &Response{
+		Version: "HTTP/1.1",
+		Status:  502,
+		Phrase:  "Bad Gateway",
+	}
+	res.Headers.Add("X-Proxy-Fixture", "miss")
+	res.Headers.Add("Content-Type", "text/plain; charset=utf-8")
+	res.Headers.Add("Content-Length", strconv.Itoa(len(body)))
+	return res, body
+}
+
+// replayFixture answers req, which is to be forwarded, from the fixtures
+// once its body has been received.
+func (t *transaction) replayFixture(s *FixtureStore, req *Request) {
+	r := s.matchRequest(req)
+	h := sha256.New()
+	t.wantBody()
+	for done := !req.HasBody(); !done; {
+		switch msg := (<-t.clChan).(type) {
+		case *RequestBodyReceived:
+			h.Write(msg.Body)
+			done = msg.IsEnd
+		default:
+			t.handleClientMessage(msg)
+			t.wait()
+			return
+		}
+	}
+	r.BodySHA256 = hex.EncodeToString(h.Sum(nil))
+
+	f, err := s.lookup(&r)
+	if err != nil {
+		log.Printf("fixture miss: %s %s: %v\n", r.Method, r.URI, err)
+		t.sendResponse(fixtureMissResponse(&r, err))
+		t.wait()
+		return
+	}
+	log.Printf("fixture replayed: %s %s\n", r.Method, r.URI)
+	t.forwardHeader(f.response())
+	t.forwardBody(f.Body, true)
+	t.wait()
+}
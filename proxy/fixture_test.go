@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// fixtureTestRequest sends a POST through a new connection, and returns
+// the status and body of the response.
+func fixtureTestRequest(t *testing.T, uri, lang, body string) (string, string) {
+	conn, peer := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		handle(conn)
+		close(done)
+	}()
+	defer func() {
+		peer.Close()
+		<-done
+	}()
+	go io.WriteString(peer, "POST "+uri+" HTTP/1.1\r\n"+
+		"Accept-Language: "+lang+"\r\n"+
+		"Content-Length: "+strconv.Itoa(len(body))+"\r\n\r\n"+body)
+	return readTestResponse(t, bufio.NewReader(peer))
+}
+
+func TestFixtures(t *testing.T) {
+	dir := t.TempDir()
+	config := FixturesConfig{Mode: FixturesRecord, Dir: dir,
+		MatchHeaders: []string{"Accept-Language"}, MaxBody: 64}
+	s, err := NewFixtureStore(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	withSettings(t, func(st *settings) { st.fixtures = s })
+
+	// Origin echoing request bodies
+	ln, accepted := listen(t)
+	go func() {
+		for conn := range accepted {
+			go func(conn net.Conn) {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				n := 0
+				for _, line := range readTestRequestHeader(r) {
+					if v, ok := strings.CutPrefix(line, "Content-Length: "); ok {
+						n, _ = strconv.Atoi(v)
+					}
+				}
+				b := make([]byte, n)
+				io.ReadFull(r, b)
+				io.WriteString(conn, "HTTP/1.1 200 OK\r\n"+
+					"Content-Length: "+strconv.Itoa(n+5)+"\r\n\r\necho "+string(b))
+			}(conn)
+		}
+	}()
+	uri := "http://" + ln.Addr().String() + "/echo"
+	status, body := fixtureTestRequest(t, uri, "en", "hello")
+	ExpectEqual(t, "HTTP/1.1 200 OK", status)
+	ExpectEqual(t, "echo hello", body)
+	// Bodies over MaxBody aren't recorded
+	long := strings.Repeat("x", 64)
+	status, body = fixtureTestRequest(t, uri, "en", long)
+	ExpectEqual(t, "echo "+long, body)
+	entries, _ := os.ReadDir(dir)
+	ExpectEqual(t, "1", strconv.Itoa(len(entries)))
+
+	// Replayed without the origin
+	ln.Close()
+	config.Mode = FixturesReplay
+	if s, err = NewFixtureStore(config); err != nil {
+		t.Fatal(err)
+	}
+	withSettings(t, func(st *settings) { st.fixtures = s })
+	status, body = fixtureTestRequest(t, uri, "en", "hello")
+	ExpectEqual(t, "HTTP/1.1 200 OK", status)
+	ExpectEqual(t, "echo hello", body)
+
+	for _, c := range []struct{ lang, body string }{
+		{"en", "bye"}, {"fr", "hello"},
+	} {
+		status, body = fixtureTestRequest(t, uri, c.lang, c.body)
+		ExpectEqual(t, "HTTP/1.1 502 Bad Gateway", status)
+		if !strings.HasPrefix(body, "No fixture for POST "+uri+"\n") {
+			t.Errorf("Unexpected body: %s", body)
+		}
+	}
+}
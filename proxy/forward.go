@@ -0,0 +1,126 @@
+package main
+
+import (
+	"net"
+	"strings"
+)
+
+// Headers only meaningful for a single connection (RFC 7230 section 6.1).
+// Transfer-Encoding isn't here because the handlers decode and encode the
+// chunked coding themselves, while other codings are passed through.
+var hopByHopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"TE",
+	"Trailer",
+	"Upgrade",
+}
+
+// removeHopByHop removes hop-by-hop fields, including those listed in
+// Connection.
+func removeHopByHop(h *HTTPHeader) {
+	for _, name := range strings.Split(h.Joined("connection"), ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			h.Del(name)
+		}
+	}
+	for _, name := range hopByHopHeaders {
+		h.Del(name)
+	}
+}
+
+// ForwardingConfig selects the headers added to forwarded messages.
+type ForwardingConfig struct {
+	Via           bool   `json:"via"`             // Via on requests and responses
+	ViaName       string `json:"via_name"`        // Name of the proxy in Via
+	XForwardedFor bool   `json:"x_forwarded_for"` // X-Forwarded-For on requests
+	Forwarded     bool   `json:"forwarded"`       // Forwarded (RFC 7239) on requests
+}
+
+// "HTTP/1.1" is "1.1" in Via.
+func (fw *ForwardingConfig) viaValue(version string) string {
+	return strings.TrimPrefix(version, "HTTP/") + " " + fw.ViaName
+}
+
+// forwardedFor returns a node in Forwarded, where IPv6 addresses are
+// quoted and bracketed.
+func forwardedFor(ip string) string {
+	if strings.Contains(ip, ":") {
+		return "\"[" + ip + "]\""
+	}
+	return ip
+}
+
+// forwardRequest returns a copy of req to be sent to the server. clientAddr
+// is the address of the client connection.
+func (fw *ForwardingConfig) forwardRequest(
+	req *Request, clientAddr net.Addr) *Request {
+	out := *req
+	out.Headers = req.Headers.Clone()
+	removeHopByHop(&out.Headers)
+	// The body is sent chunked, which a server might not prefer
+	if out.Headers.Get("transfer-encoding") != "" {
+		out.Headers.Del("Content-Length")
+	}
+	// Upgrade is passed through, switching both connections if accepted
+	if req.isUpgrade() {
+		out.Headers.Add("Connection", "Upgrade")
+		out.Headers.Add("Upgrade", req.Headers.Joined("upgrade"))
+	}
+	// The proxy's own version is sent
+	out.Version = "HTTP/1.1"
+	// Host must be the one in an absolute-form URI if given
+	out.URI = req.originForm()
+	out.Authority = ""
+	if req.Authority != "" {
+		out.Headers.Set("Host", req.Authority)
+	}
+
+	if fw.Via {
+		out.Headers.Add("Via", fw.viaValue(req.Version))
+	}
+	ip := clientAddr.String()
+	if host, _, err := net.SplitHostPort(ip); err == nil {
+		ip = host
+	}
+	if fw.XForwardedFor {
+		if xff := out.Headers.Joined("x-forwarded-for"); xff != "" {
+			out.Headers.Set("X-Forwarded-For", xff+", "+ip)
+		} else {
+			out.Headers.Add("X-Forwarded-For", ip)
+		}
+	}
+	if fw.Forwarded {
+		fwd := "for=" + forwardedFor(ip) + ";proto=http"
+		if host := req.TargetHost(); host != "" {
+			fwd += ";host=\"" + host + "\""
+		}
+		if prev := out.Headers.Joined("forwarded"); prev != "" {
+			fwd = prev + ", " + fwd
+		}
+		out.Headers.Set("Forwarded", fwd)
+	}
+	return &out
+}
+
+// forwardResponse returns a copy of res to be sent to the client.
+func (fw *ForwardingConfig) forwardResponse(res *Response) *Response {
+	out := *res
+	out.Headers = res.Headers.Clone()
+	removeHopByHop(&out.Headers)
+	// The body is read by Transfer-Encoding rather than Content-Length
+	if out.Headers.Get("transfer-encoding") != "" {
+		out.Headers.Del("Content-Length")
+	}
+	// Connection is added by ClientHandler
+	if res.Status == 101 {
+		out.Headers.Add("Upgrade", res.Headers.Joined("upgrade"))
+	}
+	if fw.Via {
+		out.Headers.Add("Via", fw.viaValue(res.Version))
+	}
+	return &out
+}
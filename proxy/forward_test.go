@@ -0,0 +1,116 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestForwardRequest(t *testing.T) {
+	req := &Request{
+		Method:  "GET",
+		URI:     "/",
+		Version: "HTTP/1.0",
+		Headers: HTTPHeader{
+			{"Host", "example.com"},
+			{"Connection", "keep-alive, X-Hop"},
+			{"X-Hop", "1"},
+			{"Proxy-Authorization", "Basic Zm9vOmJhcg=="},
+			{"Proxy-Connection", "keep-alive"},
+			{"X-Forwarded-For", "10.0.0.1"},
+			{"Accept", "*/*"},
+		},
+	}
+	addr := &net.TCPAddr{IP: net.ParseIP("192.168.0.2"), Port: 1234}
+	fw := ForwardingConfig{
+		Via:           true,
+		ViaName:       "proxy",
+		XForwardedFor: true,
+		Forwarded:     true,
+	}
+
+	out := fw.forwardRequest(req, addr)
+	ExpectEqual(t, "HTTP/1.1", out.Version)
+	var names []string
+	for _, f := range out.Headers {
+		names = append(names, f.Name)
+	}
+	ExpectEqual(t, "Host,X-Forwarded-For,Accept,Via,Forwarded",
+		strings.Join(names, ","))
+	ExpectEqual(t, "1.0 proxy", out.Headers.Get("via"))
+	ExpectEqual(t, "10.0.0.1, 192.168.0.2", out.Headers.Get("x-forwarded-for"))
+	ExpectEqual(t, "for=192.168.0.2;proto=http;host=\"example.com\"",
+		out.Headers.Get("forwarded"))
+	if len(req.Headers) != 7 {
+		t.Errorf("Original request was modified")
+	}
+}
+
+func TestForwardRequestAbsoluteForm(t *testing.T) {
+	cases := []struct {
+		uri, authority, origin string
+	}{
+		{"http://example.com/a/b?q=1", "example.com", "/a/b?q=1"},
+		{"http://example.com:8080", "example.com:8080", "/"},
+		{"HTTP://example.com?q=1#frag", "example.com", "/?q=1"},
+		{"/index.html", "", "/index.html"},
+	}
+	for _, c := range cases {
+		req := &Request{
+			Method:  "GET",
+			URI:     c.uri,
+			Version: "HTTP/1.1",
+			Headers: HTTPHeader{{"Host", "other.example.com"}},
+		}
+		if err := req.parseTarget(); err != nil {
+			t.Errorf("%s: %v", c.uri, err)
+			continue
+		}
+		ExpectEqual(t, c.authority, req.Authority)
+
+		var fw ForwardingConfig
+		out := fw.forwardRequest(req, &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		ExpectEqual(t, c.origin, out.URI)
+		if c.authority != "" {
+			ExpectEqual(t, c.authority, out.Headers.Get("host"))
+		}
+	}
+
+	req := &Request{Method: "GET", URI: "ftp://example.com/", Version: "HTTP/1.1"}
+	if err := req.parseTarget(); err == nil {
+		t.Errorf("Unsupported scheme was accepted")
+	}
+}
+
+func TestForwardRequestFraming(t *testing.T) {
+	req := &Request{
+		Method:  "POST",
+		URI:     "/",
+		Version: "HTTP/1.1",
+		Headers: HTTPHeader{
+			{"Host", "example.com"},
+			{"Content-Length", "3"},
+			{"Transfer-Encoding", "chunked"},
+		},
+	}
+	var fw ForwardingConfig
+	out := fw.forwardRequest(req, &net.TCPAddr{IP: net.ParseIP("127.0.0.1")})
+	ExpectEqual(t, "", out.Headers.Get("content-length"))
+	ExpectEqual(t, "chunked", out.Headers.Get("transfer-encoding"))
+}
+
+func TestForwardResponseFraming(t *testing.T) {
+	res := &Response{
+		Version: "HTTP/1.1",
+		Status:  200,
+		Phrase:  "OK",
+		Headers: HTTPHeader{
+			{"Transfer-Encoding", "chunked"},
+			{"Content-Length", "3"},
+		},
+	}
+	var fw ForwardingConfig
+	out := fw.forwardResponse(res)
+	ExpectEqual(t, "", out.Headers.Get("content-length"))
+	ExpectEqual(t, "chunked", out.Headers.Get("transfer-encoding"))
+}
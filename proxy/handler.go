@@ -2,18 +2,32 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"net"
+	"net/url"
 	"strconv"
 	"strings"
-	"unicode"
+	"time"
 )
 
 var _ = log.Println
 
-// Not map[string][]string, unlike http.Header
-type HTTPHeader map[string]string
+// Requests on a persistent client connection
+var keepAliveMaxRequests = 100
+
+// Timeouts of a request. Zero means no timeout.
+type Timeouts struct {
+	Dial     time.Duration // Connecting to a server
+	Header   time.Duration // Reading a whole request or response header
+	BodyIdle time.Duration // Waiting for each piece of a body
+	Request  time.Duration // From reading a request to sending the response
+	// Waiting for the next request on a persistent client connection
+	KeepAlive time.Duration
+}
 
 type Request struct {
 	Method  string
@@ -21,6 +35,9 @@ type Request struct {
 	Version string
 	Headers HTTPHeader
 	//Body    []byte
+
+	// "host:port" part of URI in absolute-form, or "" in origin-form
+	Authority string
 }
 
 type Response struct {
@@ -31,6 +48,119 @@ type Response struct {
 	//Body    []byte
 }
 
+// parseTarget sets Authority if URI is in absolute-form, which is what
+// clients send to a proxy, e.g. "http://example.com/index.html".
+func (req *Request) parseTarget() error {
+	if req.Method == "CONNECT" {
+		// authority-form, e.g. "example.com:443"
+		if _, _, err := net.SplitHostPort(req.URI); err != nil {
+			return fmt.Errorf("Invalid CONNECT target: %s", req.URI)
+		}
+		req.Authority = req.URI
+		return nil
+	}
+	if strings.HasPrefix(req.URI, "/") || req.URI == "*" {
+		return nil
+	}
+	u, err := url.Parse(req.URI)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return fmt.Errorf("Invalid request target: %s", req.URI)
+	}
+	if !strings.EqualFold(u.Scheme, "http") {
+		return fmt.Errorf("Unsupported scheme: %s", u.Scheme)
+	}
+	req.Authority = u.Host
+	return nil
+}
+
+// TargetHost returns the host the request is for, taken from an
+// absolute-form URI or else the Host header.
+func (req *Request) TargetHost() string {
+	if req.Authority != "" {
+		return req.Authority
+	}
+	return req.Headers.Get("host")
+}
+
+// originForm returns URI without the scheme and authority, e.g.
+// "/index.html?q=1" for "http://example.com/index.html?q=1".
+func (req *Request) originForm() string {
+	if req.Authority == "" {
+		return req.URI
+	}
+	rest := req.URI[strings.Index(req.URI, "://")+3:]
+	pos := strings.IndexAny(rest, "/?#")
+	if pos == -1 {
+		return "/"
+	}
+	rest = rest[pos:]
+	if pos := strings.Index(rest, "#"); pos != -1 {
+		rest = rest[:pos]
+	}
+	if !strings.HasPrefix(rest, "/") {
+		rest = "/" + rest
+	}
+	return rest
+}
+
+// bodyFraming returns how the request body is framed. A request without
+// Transfer-Encoding or Content-Length doesn't have a body, while one with
+// Transfer-Encoding must end in chunked (RFC 9112 section 6.3).
+func (req *Request) bodyFraming() (chunked bool, length int64, err error) {
+	if isChunked(req.Headers) {
+		return true, -1, nil
+	}
+	if req.Headers.Get("transfer-encoding") != "" {
+		return false, 0, fmt.Errorf("Invalid Transfer-Encoding")
+	}
+	length, err = parseContentLength(req.Headers)
+	if length < 0 {
+		length = 0
+	}
+	return false, length, err
+}
+
+func (req *Request) HasBody() bool {
+	chunked, length, err := req.bodyFraming()
+	return err == nil && (chunked || length > 0)
+}
+
+// HTTP/1.1 connections are persistent unless "Connection: close" is given,
+// while HTTP/1.0 ones need "Connection: keep-alive".
+func (req *Request) wantsKeepAlive() bool {
+	conn := req.Headers.Joined("connection")
+	if req.Version == "HTTP/1.0" {
+		return hasToken(conn, "keep-alive")
+	}
+	return !hasToken(conn, "close")
+}
+
+// isUpgrade reports whether req asks to switch the protocol of the
+// connection, as WebSocket does.
+func (req *Request) isUpgrade() bool {
+	return req.Version == "HTTP/1.1" && req.Headers.Get("upgrade") != "" &&
+		hasToken(req.Headers.Joined("connection"), "upgrade")
+}
+
+// hasToken reports whether the comma-separated list v contains token.
+func hasToken(v, token string) bool {
+	for _, t := range strings.Split(v, ",") {
+		if strings.EqualFold(strings.TrimSpace(t), token) {
+			return true
+		}
+	}
+	return false
+}
+
+// Responses to HEAD, successful ones to CONNECT and 1xx, 204 and 304
+// responses never have a body.
+func responseHasBody(method string, status int) bool {
+	if method == "HEAD" || (method == "CONNECT" && status/100 == 2) {
+		return false
+	}
+	return status/100 != 1 && status != 204 && status != 304
+}
+
 var ResponseInternalError = &Response{
 	Version: "HTTP/1.1",
 	Status:  500,
@@ -43,8 +173,67 @@ var ResponseBadRequest = &Response{
 	Phrase:  "Bad Request",
 }
 
+var ResponseBadGateway = &Response{
+	Version: "HTTP/1.1",
+	Status:  502,
+	Phrase:  "Bad Gateway",
+}
+
+var ResponseRequestTimeout = &Response{
+	Version: "HTTP/1.1",
+	Status:  408,
+	Phrase:  "Request Timeout",
+}
+
+var ResponseGatewayTimeout = &Response{
+	Version: "HTTP/1.1",
+	Status:  504,
+	Phrase:  "Gateway Timeout",
+}
+
+// isTimeout reports whether err is caused by a deadline.
+func isTimeout(err error) bool {
+	var nerr net.Error
+	return errors.As(err, &nerr) && nerr.Timeout()
+}
+
+// A deadliner is a connection whose reads can time out.
+type deadliner interface {
+	SetReadDeadline(t time.Time) error
+}
+
 type BaseHandler struct {
 	r *bufio.Reader
+	// Read deadlines are set on conn if it's not nil
+	conn     deadliner
+	timeouts Timeouts
+	// No read goes beyond this unless it's zero
+	deadline time.Time
+}
+
+// setDeadline makes the next reads time out after d.
+func (h *BaseHandler) setDeadline(d time.Duration) {
+	if h.conn == nil {
+		return
+	}
+	var t time.Time
+	if d > 0 {
+		t = time.Now().Add(d)
+	}
+	if !h.deadline.IsZero() && (t.IsZero() || h.deadline.Before(t)) {
+		t = h.deadline
+	}
+	h.conn.SetReadDeadline(t)
+}
+
+// send sends msg to ch unless quit is closed, and reports whether it's sent.
+func send(ch chan interface{}, msg interface{}, quit chan struct{}) bool {
+	select {
+	case ch <- msg:
+		return true
+	case <-quit:
+		return false
+	}
 }
 
 // similar to readLineSlice() in net/textproto/reader.go
@@ -67,25 +256,199 @@ func (h *BaseHandler) ReadLine() (string, error) {
 }
 
 func (h *BaseHandler) ReadHeaders() (HTTPHeader, error) {
-	headers := make(map[string]string)
+	headers := HTTPHeader{}
 	for {
 		line, err := h.ReadLine()
 		if err != nil {
-			return nil, fmt.Errorf("Failed to read headers")
+			return nil, fmt.Errorf("Failed to read headers: %w", err)
 		}
 		if len(line) == 0 {
 			break
 		}
+		// Obsolete line folding continues the previous field
+		if (line[0] == ' ' || line[0] == '\t') && len(headers) > 0 {
+			last := &headers[len(headers)-1]
+			last.Value += " " + strings.TrimSpace(line)
+			continue
+		}
 		fs := strings.SplitN(line, ":", 2)
 		if len(fs) != 2 {
 			return nil, fmt.Errorf("Invalid header format")
 		}
-		hdr := strings.ToLower(strings.TrimSpace(fs[0]))
-		headers[hdr] = strings.TrimSpace(fs[1])
+		headers.Add(strings.TrimSpace(fs[0]), strings.TrimSpace(fs[1]))
 	}
 	return headers, nil
 }
 
+// isChunked reports whether the final transfer coding is "chunked".
+func isChunked(headers HTTPHeader) bool {
+	te := headers.Joined("transfer-encoding")
+	if te == "" {
+		return false
+	}
+	codings := strings.Split(te, ",")
+	last := strings.TrimSpace(codings[len(codings)-1])
+	return strings.EqualFold(last, "chunked")
+}
+
+// parseContentLength returns -1 if there's no Content-Length header.
+// Repeated fields are allowed only if they have the same value.
+func parseContentLength(headers HTTPHeader) (int64, error) {
+	values := headers.Values("content-length")
+	if len(values) == 0 {
+		return -1, nil
+	}
+	for _, v := range values[1:] {
+		if v != values[0] {
+			return 0, fmt.Errorf("Conflicting Content-Length")
+		}
+	}
+	// ParseInt alone would take a sign, which other parsers may not
+	if !isDigits(values[0], "0123456789") {
+		return 0, fmt.Errorf("Invalid Content-Length")
+	}
+	cl, err := strconv.ParseInt(values[0], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid Content-Length")
+	}
+	return cl, nil
+}
+
+// isDigits reports whether s is a non-empty string of digits.
+func isDigits(s, digits string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		if !strings.ContainsRune(digits, c) {
+			return false
+		}
+	}
+	return true
+}
+
+// encodeChunk frames b as a chunk, followed by the last chunk if isEnd.
+func encodeChunk(b []byte, isEnd bool) []byte {
+	var buf bytes.Buffer
+	if len(b) > 0 {
+		fmt.Fprintf(&buf, "%x\r\n", len(b))
+		buf.Write(b)
+		buf.WriteString("\r\n")
+	}
+	if isEnd {
+		buf.WriteString("0\r\n\r\n")
+	}
+	return buf.Bytes()
+}
+
+func (h *BaseHandler) readChunkSize() (int64, error) {
+	h.setDeadline(h.timeouts.BodyIdle)
+	line, err := h.ReadLine()
+	if err != nil {
+		return 0, fmt.Errorf("Failed to read chunk size: %w", err)
+	}
+	// Chunk extensions are ignored, and only they may be preceded by
+	// whitespace
+	if pos := strings.Index(line, ";"); pos != -1 {
+		line = strings.TrimRight(line[:pos], " \t")
+	}
+	if !isDigits(line, "0123456789abcdefABCDEF") {
+		return 0, fmt.Errorf("Invalid chunk size")
+	}
+	size, err := strconv.ParseInt(line, 16, 64)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid chunk size")
+	}
+	return size, nil
+}
+
+// readFull reads exactly n bytes. emit is called for each piece read and
+// owns the slice passed to it.
+func (h *BaseHandler) readFull(n int64, emit func([]byte)) error {
+	for n > 0 {
+		size := int64(4096)
+		if n < size {
+			size = n
+		}
+		b := make([]byte, size)
+		h.setDeadline(h.timeouts.BodyIdle)
+		m, err := h.r.Read(b)
+		if m > 0 {
+			n -= int64(m)
+			emit(b[:m])
+		}
+		if err != nil && n > 0 {
+			return err
+		}
+	}
+	return nil
+}
+
+func (h *BaseHandler) readChunkedBody(emit func([]byte, bool)) error {
+	for {
+		size, err := h.readChunkSize()
+		if err != nil {
+			return err
+		}
+		if size == 0 {
+			break
+		}
+		err = h.readFull(size, func(b []byte) { emit(b, false) })
+		if err != nil {
+			return err
+		}
+		if line, err := h.ReadLine(); err != nil || len(line) != 0 {
+			return fmt.Errorf("Invalid chunk terminator")
+		}
+	}
+	// Trailers aren't forwarded
+	if _, err := h.ReadHeaders(); err != nil {
+		return err
+	}
+	emit(nil, true)
+	return nil
+}
+
+func (h *BaseHandler) readBodyUntilEOF(emit func([]byte, bool)) error {
+	for {
+		b := make([]byte, 4096)
+		h.setDeadline(h.timeouts.BodyIdle)
+		m, err := h.r.Read(b)
+		if m > 0 {
+			emit(b[:m], false)
+		}
+		if err == io.EOF {
+			emit(nil, true)
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// readBody reads a message body framed by chunked coding, by length if
+// length >= 0, or by the connection close otherwise. isEnd is set on the
+// last call of emit.
+func (h *BaseHandler) readBody(
+	chunked bool, length int64, emit func(b []byte, isEnd bool)) error {
+	if chunked {
+		return h.readChunkedBody(emit)
+	}
+	if length < 0 {
+		return h.readBodyUntilEOF(emit)
+	}
+	if length == 0 {
+		emit(nil, true)
+		return nil
+	}
+	var n int64
+	return h.readFull(length, func(b []byte) {
+		n += int64(len(b))
+		emit(b, n == length)
+	})
+}
+
 // Messages
 
 type ErrorOccurred struct {
@@ -112,26 +475,92 @@ type ResponseBodyReceived struct {
 
 type ClientDone struct{}
 
+// BodyWanted tells ClientHandler that the request body is to be read, for
+// which 100 Continue is sent first if the client expects it.
+type BodyWanted struct{}
+
 // Client Handler
 
+// A ClientHandler serves requests on a client connection one by one. Start
+// is called for each of them after the previous one's ClientDone.
 type ClientHandler struct {
 	h   BaseHandler
 	w   io.Writer
 	req *Request
+	// Whether the response body is re-chunked for the client
+	chunked bool
+	// Whether the connection can be reused after the response
+	keepAlive bool
+	// Number of requests read on the connection
+	nreq int
+	// Tells the body reader whether to read the body after 100 Continue,
+	// or nil if it isn't waiting
+	cont chan bool
+	// Closed by Stop for the current request
+	quit chan struct{}
 }
 
 func NewClientHandler(r io.Reader, w io.Writer) *ClientHandler {
 	return &ClientHandler{
-		h:   BaseHandler{bufio.NewReader(r)},
+		h:   BaseHandler{r: bufio.NewReader(r)},
 		w:   w,
 		req: &Request{},
 	}
 }
 
+// SetTimeouts makes reads from conn time out as specified by t.
+func (h *ClientHandler) SetTimeouts(conn deadliner, t Timeouts) {
+	h.h.conn = conn
+	h.h.timeouts = t
+}
+
+// SetDeadline limits reads for the next request to t, unless it's zero.
+func (h *ClientHandler) SetDeadline(t time.Time) {
+	h.h.deadline = t
+}
+
+// Stop makes the handler give up the current request without sending
+// ClientDone. The connection can't be used after that.
+func (h *ClientHandler) Stop() {
+	select {
+	case <-h.quit:
+	default:
+		close(h.quit)
+	}
+}
+
+// WaitForRequest blocks until the next request arrives. It returns io.EOF
+// if the client closes the connection.
+func (h *ClientHandler) WaitForRequest() error {
+	_, err := h.h.r.Peek(1)
+	return err
+}
+
+// Reader returns the reader of the connection, which may have buffered
+// bytes sent after the request.
+func (h *ClientHandler) Reader() io.Reader {
+	return h.h.r
+}
+
+// KeepAlive reports whether another request can be read from the
+// connection. It's only valid after ClientDone.
+func (h *ClientHandler) KeepAlive() bool {
+	return h.keepAlive
+}
+
+func (h *ClientHandler) reset() {
+	h.req = &Request{}
+	h.chunked = false
+	h.keepAlive = false
+	h.cont = nil
+	h.nreq++
+	h.quit = make(chan struct{})
+}
+
 func (h *ClientHandler) readRequestLine() error {
 	rl, err := h.h.ReadLine()
 	if err != nil {
-		return fmt.Errorf("Failed to read request line: %v", err)
+		return fmt.Errorf("Failed to read request line: %w", err)
 	}
 	fields := strings.Split(rl, " ")
 	if len(fields) != 3 {
@@ -140,7 +569,7 @@ func (h *ClientHandler) readRequestLine() error {
 	h.req.Method = fields[0]
 	h.req.URI = fields[1]
 	h.req.Version = fields[2]
-	return nil
+	return h.req.parseTarget()
 }
 
 func (h *ClientHandler) readHeaders() error {
@@ -151,20 +580,116 @@ func (h *ClientHandler) readHeaders() error {
 	return err
 }
 
+func (h *ClientHandler) expectsContinue() bool {
+	expect := h.req.Headers.Get("expect")
+	return h.req.Version == "HTTP/1.1" &&
+		strings.EqualFold(expect, "100-continue")
+}
+
+// readBodyIfNeeded returns nil if the request doesn't have a body.
 func (h *ClientHandler) readBodyIfNeeded() chan interface{} {
+	chunked, length, err := h.req.bodyFraming()
+	if err == nil && !chunked && length == 0 {
+		return nil
+	}
+	// The client waits for 100 Continue, which is sent on BodyWanted
+	// rather than before the request is accepted
+	var cont chan bool
+	if err == nil && h.expectsContinue() {
+		cont = make(chan bool, 1)
+		h.cont = cont
+	}
+	quit := h.quit
 	ch := make(chan interface{})
 	go func() {
-		// TODO: Implement
+		defer close(ch)
+		if err != nil {
+			send(ch, &ErrorOccurred{err}, quit)
+			return
+		}
+		if cont != nil {
+			select {
+			case ok := <-cont:
+				if !ok {
+					return
+				}
+			case <-quit:
+				return
+			}
+		}
+		err := h.h.readBody(chunked, length, func(b []byte, isEnd bool) {
+			send(ch, &RequestBodyReceived{b, isEnd}, quit)
+		})
+		if err != nil {
+			nerr := fmt.Errorf("Failed to read request body: %w", err)
+			send(ch, &ErrorOccurred{nerr}, quit)
+		}
 	}()
 	return ch
 }
 
+// The connection is kept only if the client wants it and the end of the
+// response can be told without closing it.
+func (h *ClientHandler) canKeepAlive(res *Response) bool {
+	if h.nreq >= keepAliveMaxRequests || !h.req.wantsKeepAlive() {
+		return false
+	}
+	// The connection is taken over by the new protocol
+	if res.Status == 101 {
+		return false
+	}
+	if h.chunked || !responseHasBody(h.req.Method, res.Status) {
+		return true
+	}
+	// A body in other codings, or dechunked, ends with the connection
+	if res.Headers.Get("transfer-encoding") != "" {
+		return false
+	}
+	length, err := parseContentLength(res.Headers)
+	return err == nil && length >= 0
+}
+
 func (h *ClientHandler) writeResponseHeader(res *Response) {
-	fmt.Fprintf(h.w, "%s %d %s\r\n", res.Version, res.Status, res.Phrase)
-	for k, v := range res.Headers {
-		fmt.Fprintf(h.w, "%s: %s\r\n", k, v)
+	http10 := h.req.Version == "HTTP/1.0"
+	// Transfer-Encoding of a response without a body, as to HEAD, only
+	// tells what a GET would get
+	chunked := isChunked(res.Headers) &&
+		responseHasBody(h.req.Method, res.Status)
+	// HTTP/1.0 clients don't know chunked coding, so the body is sent as
+	// is and delimited by closing the connection.
+	dechunk := chunked && http10
+	h.chunked = chunked && !dechunk
+	h.keepAlive = h.canKeepAlive(res)
+
+	// The connection to the client is managed here
+	headers := res.Headers.Clone()
+	headers.Del("connection")
+	headers.Del("keep-alive")
+	// Content-Length is wrong with Transfer-Encoding (RFC 9112 section 6.3)
+	if headers.Get("transfer-encoding") != "" {
+		headers.Del("content-length")
 	}
-	fmt.Fprintf(h.w, "\r\n")
+	if dechunk {
+		headers.Del("transfer-encoding")
+	}
+	if h.keepAlive && http10 {
+		headers.Add("Connection", "keep-alive")
+		max := keepAliveMaxRequests - h.nreq
+		if timeout := h.h.timeouts.KeepAlive; timeout > 0 {
+			headers.Add("Keep-Alive", fmt.Sprintf("timeout=%d, max=%d",
+				int(timeout/time.Second), max))
+		} else {
+			headers.Add("Keep-Alive", fmt.Sprintf("max=%d", max))
+		}
+	} else if res.Status == 101 {
+		headers.Add("Connection", "Upgrade")
+	} else if !h.keepAlive && !http10 {
+		headers.Add("Connection", "close")
+	}
+
+	// The proxy's own version is sent, not the server's
+	fmt.Fprintf(h.w, "HTTP/1.1 %d %s\r\n", res.Status, res.Phrase)
+	headers.Write(h.w)
 }
 
 func (h *ClientHandler) writeBody(b []byte) error {
@@ -178,17 +703,34 @@ func (h *ClientHandler) writeBody(b []byte) error {
 	return nil
 }
 
+// The body has been decoded by ServerHandler, so it's chunked again here.
+func (h *ClientHandler) writeChunk(b []byte, isEnd bool) error {
+	return h.writeBody(encodeChunk(b, isEnd))
+}
+
 func (h *ClientHandler) handleMessage(m interface{}) (bool, error) {
 	done := false
 	switch msg := m.(type) {
 	case *ResponseHeaderReceived:
 		//log.Printf("sending res hdr to client: %v\n", msg.Res)
 		h.writeResponseHeader(msg.Res)
+	case *BodyWanted:
+		if h.cont != nil {
+			fmt.Fprintf(h.w, "HTTP/1.1 100 Continue\r\n\r\n")
+			h.cont <- true
+			h.cont = nil
+		}
 	case *ResponseBodyReceived:
 		done = msg.IsEnd
 		//log.Printf("sending res body to client: n=%v, done=%t\n",
 		//	len(msg.Body), done)
-		if err := h.writeBody(msg.Body); err != nil {
+		var err error
+		if h.chunked {
+			err = h.writeChunk(msg.Body, msg.IsEnd)
+		} else {
+			err = h.writeBody(msg.Body)
+		}
+		if err != nil {
 			//log.Printf("failed to write client: %v\n", err)
 			return true, err
 		}
@@ -200,39 +742,115 @@ func (h *ClientHandler) handleMessage(m interface{}) (bool, error) {
 	return done, nil
 }
 
-func (h *ClientHandler) loop(ch chan interface{}) {
-	readch := h.readBodyIfNeeded()
+func (h *ClientHandler) loop(ch, readch chan interface{}) {
+	quit := h.quit
+	// A message read from the client is held in pending until it's taken
+	// from ch, so that responses can still be received in the meantime.
+	// No more is read from the client until then.
+	var pending interface{}
+	// Once writing to the client fails, messages are discarded until the
+	// error is taken.
+	failed := false
 	for {
+		var sendch, recvch chan interface{}
+		if pending != nil {
+			sendch = ch
+		} else {
+			recvch = readch
+		}
 		select {
+		case <-quit:
+			return
 		case msg := <-ch:
+			if failed {
+				continue
+			}
 			done, err := h.handleMessage(msg)
 			if err != nil {
-				ch <- &ErrorOccurred{err}
+				failed = true
+				pending = &ErrorOccurred{err}
+				continue
 			}
 			if done {
+				h.finish(readch)
+				return
+			}
+		case sendch <- pending:
+			pending = nil
+			if failed {
+				h.finish(readch)
 				return
 			}
-		case msg := <-readch:
-			ch <- msg
+		case msg, ok := <-recvch:
+			if !ok {
+				readch = nil
+				continue
+			}
+			if body, ok := msg.(*RequestBodyReceived); !ok || body.IsEnd {
+				// Nothing more is read from the client
+				readch = nil
+			}
+			pending = msg
 		}
 	}
 }
 
+// finish is called when the response has been sent. readch is nil if the
+// request body has been read.
+func (h *ClientHandler) finish(readch chan interface{}) {
+	if readch == nil {
+		return
+	}
+	// The rest of the request body is left unread
+	h.keepAlive = false
+	if h.cont != nil {
+		// Without 100 Continue
+		h.cont <- false
+		h.cont = nil
+	}
+	go func() {
+		for range readch {
+		}
+	}()
+}
+
+func (h *ClientHandler) readRequest() error {
+	h.h.setDeadline(h.h.timeouts.Header)
+	if err := h.readRequestLine(); err != nil {
+		return err
+	}
+	if err := h.readHeaders(); err != nil {
+		return err
+	}
+	// The body can't be framed otherwise, and a Content-Length sent along
+	// with Transfer-Encoding would be trusted by some servers
+	if _, _, err := h.req.bodyFraming(); err != nil {
+		return err
+	}
+	if h.req.Headers.Get("transfer-encoding") != "" {
+		h.req.Headers.Del("content-length")
+	}
+	return nil
+}
+
 func (h *ClientHandler) Start() chan interface{} {
+	h.reset()
+	quit := h.quit
 	ch := make(chan interface{})
 	go func() {
-		defer func() {
-			ch <- &ClientDone{}
-		}()
-		if err := h.readRequestLine(); err != nil {
-			ch <- &ErrorOccurred{err}
+		defer send(ch, &ClientDone{}, quit)
+		if err := h.readRequest(); err != nil {
+			send(ch, &ErrorOccurred{err}, quit)
+			// An error response can still be sent
+			h.loop(ch, nil)
+			h.keepAlive = false
+			return
 		}
-		if err := h.readHeaders(); err != nil {
-			ch <- &ErrorOccurred{err}
+		if !send(ch, &RequestHeaderReceived{h.req}, quit) {
+			return
 		}
-		ch <- &RequestHeaderReceived{h.req}
 
-		h.loop(ch)
+		h.loop(ch, h.readBodyIfNeeded())
 	}()
 	return ch
 }
@@ -242,17 +860,75 @@ func (h *ClientHandler) Start() chan interface{} {
 type ServerHandler struct {
 	h   BaseHandler
 	w   io.Writer
+	req *Request
 	res *Response
+	// Whether the connection can be used for another request
+	reusable bool
+	// Closed when the handler has finished reading the response
+	done chan struct{}
+	// Closed by Stop
+	quit chan struct{}
 }
 
 func NewServerHandler(r io.Reader, w io.Writer) *ServerHandler {
 	return &ServerHandler{
-		h:   BaseHandler{bufio.NewReader(r)},
-		w:   w,
-		res: &Response{},
+		h:    BaseHandler{r: bufio.NewReader(r)},
+		w:    w,
+		res:  &Response{},
+		done: make(chan struct{}),
+		quit: make(chan struct{}),
+	}
+}
+
+// SetTimeouts makes reads from conn time out as specified by t, and never
+// go beyond deadline unless it's zero.
+func (h *ServerHandler) SetTimeouts(
+	conn deadliner, t Timeouts, deadline time.Time) {
+	h.h.conn = conn
+	h.h.timeouts = t
+	h.h.deadline = deadline
+}
+
+// Reader returns the reader of the connection, which may have buffered
+// bytes sent after the response header.
+func (h *ServerHandler) Reader() io.Reader {
+	return h.h.r
+}
+
+// Stop makes the handler give up the request. The connection can't be
+// used after that.
+func (h *ServerHandler) Stop() {
+	select {
+	case <-h.quit:
+	default:
+		close(h.quit)
 	}
 }
 
+// Reusable reports whether the connection can be used for another request.
+// It waits for the handler to finish, so it's only called once the end of
+// the response has been received from it.
+func (h *ServerHandler) Reusable() bool {
+	<-h.done
+	return h.reusable
+}
+
+// keepsConnection reports whether the server keeps the connection open
+// after a response whose end is told by delimited.
+func (h *ServerHandler) keepsConnection(delimited bool) bool {
+	conn := h.res.Headers.Joined("connection")
+	if !delimited || hasToken(conn, "close") || h.res.Status == 101 {
+		return false
+	}
+	if h.req != nil && hasToken(h.req.Headers.Joined("connection"), "close") {
+		return false
+	}
+	if h.res.Version == "HTTP/1.0" {
+		return hasToken(conn, "keep-alive")
+	}
+	return true
+}
+
 func parseStatusCode(ss string) (int, error) {
 	status, err := strconv.Atoi(ss)
 	first := status / 100
@@ -265,7 +941,7 @@ func parseStatusCode(ss string) (int, error) {
 func (h *ServerHandler) readStatusLine() error {
 	sl, err := h.h.ReadLine()
 	if err != nil {
-		return fmt.Errorf("Failed to read status line: %v", err)
+		return fmt.Errorf("Failed to read status line: %w", err)
 	}
 	// TODO: Not an ideal
 	fields := strings.Split(sl, " ")
@@ -289,97 +965,135 @@ func (h *ServerHandler) readHeaders() error {
 	return err
 }
 
-func (h *ServerHandler) contentLength() (int, error) {
-	cls, ok := h.res.Headers["content-length"]
-	if !ok {
-		// TODO: this should be a 411 error
-		return 0, fmt.Errorf(
-			"No Content-Length, chunked encoding isn't supported")
-	}
-	cl, err := strconv.Atoi(cls)
-	if err != nil {
-		return 0, fmt.Errorf("Invalid Content-Length")
+func (h *ServerHandler) contentLength() (int64, error) {
+	return parseContentLength(h.res.Headers)
+}
+
+func (h *ServerHandler) hasBody() bool {
+	method := ""
+	if h.req != nil {
+		method = h.req.Method
 	}
-	return cl, nil
+	return responseHasBody(method, h.res.Status)
 }
 
-// TODO: maybe I can move this to BaseHandler
-// TODO: don't rely on "Content-Length". This header doesn't always exist.
 func (h *ServerHandler) readBodyIfNeeded() chan interface{} {
 	ch := make(chan interface{})
 	go func() {
-		b := make([]byte, 4096)
-		contentLength, _ := h.contentLength()
-		for n := 0; n < contentLength; {
-			m, err := h.h.r.Read(b)
-			if err != nil {
-				nerr := fmt.Errorf("Failed to read body: %v", err)
-				ch <- &ErrorOccurred{nerr}
+		defer close(ch)
+		if !h.hasBody() {
+			h.reusable = h.keepsConnection(true)
+			send(ch, &ResponseBodyReceived{nil, true}, h.quit)
+			return
+		}
+		chunked := isChunked(h.res.Headers)
+		contentLength := int64(-1)
+		// A body in other codings ends with the connection
+		if !chunked && h.res.Headers.Get("transfer-encoding") == "" {
+			var err error
+			if contentLength, err = h.contentLength(); err != nil {
+				send(ch, &ErrorOccurred{err}, h.quit)
 				return
 			}
-			n += m
-			ch <- &ResponseBodyReceived{b[:m], n == contentLength}
+		}
+		delimited := chunked || contentLength >= 0
+		err := h.h.readBody(chunked, contentLength, func(b []byte, isEnd bool) {
+			if isEnd {
+				h.reusable = h.keepsConnection(delimited)
+			}
+			send(ch, &ResponseBodyReceived{b, isEnd}, h.quit)
+		})
+		if err != nil {
+			nerr := fmt.Errorf("Failed to read body: %w", err)
+			send(ch, &ErrorOccurred{nerr}, h.quit)
 		}
 	}()
 	return ch
 }
 
-func capitalizeHeader(h string) string {
-	ret := make([]rune, len(h))
-	cap := true
-	for i, c := range h {
-		r := rune(c)
-		if cap && unicode.IsLetter(r) {
-			ret[i] = unicode.ToUpper(r)
-			cap = false
-		} else {
-			ret[i] = r
+func (h *ServerHandler) writeRequest(req *Request) {
+	fmt.Fprintf(h.w, "%s %s %s\r\n", req.Method, req.URI, req.Version)
+	req.Headers.Write(h.w)
+}
+
+// writeBody sends the request body received from ch to the server. Once a
+// write fails the rest of the body is still taken from ch and discarded,
+// so that the sender isn't blocked.
+func (h *ServerHandler) writeBody(ch chan interface{}) error {
+	chunked := isChunked(h.req.Headers)
+	var werr error
+	for {
+		var m interface{}
+		select {
+		case m = <-ch:
+		case <-h.quit:
+			return fmt.Errorf("Stopped")
+		}
+		msg, ok := m.(*RequestBodyReceived)
+		if !ok {
+			return fmt.Errorf("Unexpected message while sending request body")
+		}
+		if werr == nil {
+			b := msg.Body
+			if chunked {
+				b = encodeChunk(b, msg.IsEnd)
+			}
+			_, werr = h.w.Write(b)
 		}
-		if c == '-' {
-			cap = true
+		if msg.IsEnd {
+			return werr
 		}
 	}
-	return string(ret)
 }
 
-func (h *ServerHandler) writeRequest(req *Request) {
-	fmt.Fprintf(h.w, "%s %s %s\r\n", req.Method, req.URI, req.Version)
-	for k, v := range req.Headers {
-		fmt.Fprintf(h.w, "%s: %s\r\n", capitalizeHeader(k), v)
+// Interim responses other than 101 aren't forwarded to the client.
+func (h *ServerHandler) readResponseHeader() error {
+	for {
+		if err := h.readStatusLine(); err != nil {
+			return err
+		}
+		if err := h.readHeaders(); err != nil {
+			return err
+		}
+		if h.res.Status/100 != 1 || h.res.Status == 101 {
+			return nil
+		}
 	}
-	fmt.Fprintf(h.w, "\r\n")
 }
 
 func (h *ServerHandler) loop(ch chan interface{}) {
 	readch := h.readBodyIfNeeded()
 	for msg := range readch {
-		ch <- msg
+		if !send(ch, msg, h.quit) {
+			return
+		}
 	}
 }
 
 func (h *ServerHandler) Start(req *Request) chan interface{} {
 	ch := make(chan interface{})
+	h.req = req
 	go func() {
+		defer close(h.done)
 		h.writeRequest(req)
-		// TODO: request body sending
-
-		if err := h.readStatusLine(); err != nil {
-			ch <- &ErrorOccurred{err}
-			return
+		if req.HasBody() {
+			if err := h.writeBody(ch); err != nil {
+				nerr := fmt.Errorf("Failed to send request body: %w", err)
+				send(ch, &ErrorOccurred{nerr}, h.quit)
+				return
+			}
 		}
-		if err := h.readHeaders(); err != nil {
-			ch <- &ErrorOccurred{err}
+
+		h.h.setDeadline(h.h.timeouts.Header)
+		if err := h.readResponseHeader(); err != nil {
+			send(ch, &ErrorOccurred{err}, h.quit)
 			return
 		}
 
-		// TODO: remove this
-		if _, err := h.contentLength(); err != nil {
-			ch <- &ErrorOccurred{err}
+		if !send(ch, &ResponseHeaderReceived{h.res}, h.quit) {
 			return
 		}
 
-		ch <- &ResponseHeaderReceived{h.res}
-
 		h.loop(ch)
 	}()
 	return ch
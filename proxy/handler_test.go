@@ -1,10 +1,14 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"io"
+	"net"
 	"strconv"
 	"strings"
 	"testing"
+	"time"
 )
 
 func ExpectEqual(t *testing.T, expect, actual string) {
@@ -27,7 +31,7 @@ func TestClientHandlerStart(t *testing.T) {
 	ExpectEqual(t, "GET", msg.Req.Method)
 	ExpectEqual(t, "/", msg.Req.URI)
 	ExpectEqual(t, "HTTP/1.1", msg.Req.Version)
-	ExpectEqual(t, "www.google.com", msg.Req.Headers["host"])
+	ExpectEqual(t, "www.google.com", msg.Req.Headers.Get("host"))
 
 	res := &Response{
 		Version: "HTTP/1.1",
@@ -36,8 +40,9 @@ func TestClientHandlerStart(t *testing.T) {
 	}
 	ch <- &ResponseHeaderReceived{res}
 	ch <- &ResponseBodyReceived{[]byte("FooBar"), true}
+	<-ch // ClientDone
 	output := w.String()
-	ExpectEqual(t, "HTTP/1.1 200 OK\r\n\r\nFooBar", output)
+	ExpectEqual(t, "HTTP/1.1 200 OK\r\nConnection: close\r\n\r\nFooBar", output)
 }
 
 func TestServerHandler(t *testing.T) {
@@ -55,8 +60,8 @@ func TestServerHandler(t *testing.T) {
 		Method:  "GET",
 		URI:     "/",
 		Version: "HTTP/1.1",
-		Headers: map[string]string{
-			"Host": "localhost",
+		Headers: HTTPHeader{
+			{"Host", "localhost"},
 		},
 	}
 	ch := h.Start(req)
@@ -68,7 +73,7 @@ func TestServerHandler(t *testing.T) {
 	ExpectEqual(t, "HTTP/1.1", hdrmsg.Res.Version)
 	ExpectEqual(t, "200", strconv.Itoa(hdrmsg.Res.Status))
 	ExpectEqual(t, "OK", hdrmsg.Res.Phrase)
-	ExpectEqual(t, "6", hdrmsg.Res.Headers["content-length"])
+	ExpectEqual(t, "6", hdrmsg.Res.Headers.Get("content-length"))
 
 	bodymsg, ok := (<-ch).(*ResponseBodyReceived)
 	if !ok {
@@ -76,3 +81,373 @@ func TestServerHandler(t *testing.T) {
 	}
 	ExpectEqual(t, "FooBar", string(bodymsg.Body))
 }
+
+func TestServerHandlerChunked(t *testing.T) {
+	ss := []string{
+		"HTTP/1.1 200 OK\r\n",
+		"Transfer-Encoding: chunked\r\n",
+		"\r\n",
+		"3;name=value\r\nFoo\r\n",
+		"3\r\nBar\r\n",
+		"0\r\n",
+		"X-Trailer: ignored\r\n",
+		"\r\n",
+	}
+	r := strings.NewReader(strings.Join(ss, ""))
+	w := new(bytes.Buffer)
+	h := NewServerHandler(r, w)
+
+	req := &Request{
+		Method:  "GET",
+		URI:     "/",
+		Version: "HTTP/1.1",
+	}
+	ch := h.Start(req)
+
+	if _, ok := (<-ch).(*ResponseHeaderReceived); !ok {
+		t.Fatalf("Failed to receive response header")
+	}
+	body := ""
+	for {
+		msg, ok := (<-ch).(*ResponseBodyReceived)
+		if !ok {
+			t.Fatalf("Failed to receive response body")
+		}
+		body += string(msg.Body)
+		if msg.IsEnd {
+			break
+		}
+	}
+	ExpectEqual(t, "FooBar", body)
+}
+
+func TestServerHandlerOtherCoding(t *testing.T) {
+	// Content-Length doesn't apply, and the body ends with the connection
+	r := strings.NewReader("HTTP/1.1 200 OK\r\nTransfer-Encoding: gzip\r\n" +
+		"Content-Length: 3\r\n\r\nFooBar")
+	h := NewServerHandler(r, new(bytes.Buffer))
+	ch := h.Start(&Request{Method: "GET", URI: "/", Version: "HTTP/1.1"})
+	if _, ok := (<-ch).(*ResponseHeaderReceived); !ok {
+		t.Fatalf("Failed to receive response header")
+	}
+	body := ""
+	for {
+		msg, ok := (<-ch).(*ResponseBodyReceived)
+		if !ok {
+			t.Fatalf("Failed to receive response body")
+		}
+		body += string(msg.Body)
+		if msg.IsEnd {
+			break
+		}
+	}
+	ExpectEqual(t, "FooBar", body)
+	ExpectEqual(t, "false", strconv.FormatBool(h.Reusable()))
+}
+
+func TestClientHandlerChunkedWithLength(t *testing.T) {
+	res := &Response{
+		Version: "HTTP/1.1",
+		Status:  200,
+		Phrase:  "OK",
+		Headers: HTTPHeader{
+			{"Transfer-Encoding", "chunked"},
+			{"Content-Length", "3"},
+		},
+	}
+	for _, c := range []struct{ version, expect string }{
+		{"HTTP/1.1", "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n" +
+			"6\r\nFooBar\r\n0\r\n\r\n"},
+		// Delimited by closing the connection
+		{"HTTP/1.0", "HTTP/1.1 200 OK\r\n\r\nFooBar"},
+	} {
+		r := strings.NewReader("GET / " + c.version +
+			"\r\nConnection: keep-alive\r\n\r\n")
+		w := new(bytes.Buffer)
+		h := NewClientHandler(r, w)
+		ch := h.Start()
+		<-ch
+		ch <- &ResponseHeaderReceived{res}
+		ch <- &ResponseBodyReceived{[]byte("FooBar"), true}
+		<-ch // ClientDone
+		ExpectEqual(t, c.expect, w.String())
+		ExpectEqual(t, strconv.FormatBool(c.version == "HTTP/1.1"),
+			strconv.FormatBool(h.KeepAlive()))
+	}
+}
+
+func TestClientHandlerChunked(t *testing.T) {
+	r := strings.NewReader("GET / HTTP/1.1\r\nHost: www.google.com\r\n\r\n")
+	w := new(bytes.Buffer)
+	h := NewClientHandler(r, w)
+
+	ch := h.Start()
+	<-ch
+
+	res := &Response{
+		Version: "HTTP/1.1",
+		Status:  200,
+		Phrase:  "OK",
+		Headers: HTTPHeader{
+			{"Transfer-Encoding", "chunked"},
+		},
+	}
+	ch <- &ResponseHeaderReceived{res}
+	ch <- &ResponseBodyReceived{[]byte("Foo"), false}
+	ch <- &ResponseBodyReceived{[]byte("Bar"), false}
+	ch <- &ResponseBodyReceived{nil, true}
+	<-ch // ClientDone
+	expect := "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n" +
+		"3\r\nFoo\r\n3\r\nBar\r\n0\r\n\r\n"
+	ExpectEqual(t, expect, w.String())
+}
+
+func TestClientHandlerHeadChunked(t *testing.T) {
+	r := strings.NewReader("HEAD / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	w := new(bytes.Buffer)
+	h := NewClientHandler(r, w)
+
+	ch := h.Start()
+	<-ch
+
+	res := &Response{
+		Version: "HTTP/1.1",
+		Status:  200,
+		Phrase:  "OK",
+		Headers: HTTPHeader{
+			{"Transfer-Encoding", "chunked"},
+		},
+	}
+	ch <- &ResponseHeaderReceived{res}
+	ch <- &ResponseBodyReceived{nil, true}
+	<-ch // ClientDone
+	// No chunk is sent, and the connection is still usable
+	ExpectEqual(t, "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n",
+		w.String())
+	ExpectEqual(t, "true", strconv.FormatBool(h.KeepAlive()))
+}
+
+func TestClientHandlerRequestBody(t *testing.T) {
+	ss := []string{
+		"POST / HTTP/1.1\r\n",
+		"Host: localhost\r\n",
+		"Transfer-Encoding: chunked\r\n",
+		"\r\n",
+		"6\r\nFooBar\r\n",
+		"0\r\n\r\n",
+	}
+	r := strings.NewReader(strings.Join(ss, ""))
+	w := new(bytes.Buffer)
+	h := NewClientHandler(r, w)
+
+	ch := h.Start()
+	if _, ok := (<-ch).(*RequestHeaderReceived); !ok {
+		t.Fatalf("Failed to receive request header")
+	}
+	body := ""
+	for {
+		msg, ok := (<-ch).(*RequestBodyReceived)
+		if !ok {
+			t.Fatalf("Failed to receive request body")
+		}
+		body += string(msg.Body)
+		if msg.IsEnd {
+			break
+		}
+	}
+	ExpectEqual(t, "FooBar", body)
+}
+
+func TestClientHandlerFraming(t *testing.T) {
+	// Content-Length is dropped in favor of chunked
+	r := strings.NewReader("POST / HTTP/1.1\r\nHost: localhost\r\n" +
+		"Content-Length: 3\r\nTransfer-Encoding: chunked\r\n\r\n" +
+		"6\r\nFooBar\r\n0\r\n\r\n")
+	h := NewClientHandler(r, new(bytes.Buffer))
+	ch := h.Start()
+	msg, ok := (<-ch).(*RequestHeaderReceived)
+	if !ok {
+		t.Fatalf("Failed to receive request header")
+	}
+	ExpectEqual(t, "", msg.Req.Headers.Get("content-length"))
+	body := ""
+	for {
+		msg, ok := (<-ch).(*RequestBodyReceived)
+		if !ok {
+			t.Fatalf("Failed to receive request body")
+		}
+		body += string(msg.Body)
+		if msg.IsEnd {
+			break
+		}
+	}
+	ExpectEqual(t, "FooBar", body)
+
+	// A body that can't be framed is rejected rather than taken as the
+	// next request
+	for _, framing := range []string{
+		"Transfer-Encoding: gzip",
+		"Content-Length: +6",
+		"Content-Length: -0",
+		"Content-Length: 0x6",
+	} {
+		r = strings.NewReader("POST / HTTP/1.1\r\nHost: localhost\r\n" +
+			framing + "\r\n\r\nGET /smuggled HTTP/1.1\r\n\r\n")
+		h = NewClientHandler(r, new(bytes.Buffer))
+		ch = h.Start()
+		if _, ok := (<-ch).(*ErrorOccurred); !ok {
+			t.Fatalf("Invalid framing was accepted: %s", framing)
+		}
+		ch <- &ResponseHeaderReceived{ResponseBadRequest}
+		ch <- &ResponseBodyReceived{nil, true}
+		<-ch // ClientDone
+		ExpectEqual(t, "false", strconv.FormatBool(h.KeepAlive()))
+	}
+
+	for _, c := range []struct {
+		size string
+		ok   bool
+	}{
+		{"6", true}, {"6 ;ext=1", true}, {"+6", false}, {" 6", false},
+		{"6 ", false}, {"0x6", false}, {"", false},
+	} {
+		h := &BaseHandler{r: bufio.NewReader(strings.NewReader(c.size + "\r\n"))}
+		size, err := h.readChunkSize()
+		ExpectEqual(t, strconv.FormatBool(c.ok), strconv.FormatBool(err == nil))
+		if c.ok {
+			ExpectEqual(t, "6", strconv.FormatInt(size, 10))
+		}
+	}
+}
+
+func TestClientHandlerContinue(t *testing.T) {
+	req := "POST / HTTP/1.1\r\nHost: localhost\r\nExpect: 100-continue\r\n" +
+		"Content-Length: 6\r\n\r\nFooBar"
+	// 100 Continue is sent only when the body is wanted
+	w := new(bytes.Buffer)
+	h := NewClientHandler(strings.NewReader(req), w)
+	ch := h.Start()
+	<-ch
+	ch <- &BodyWanted{}
+	msg, ok := (<-ch).(*RequestBodyReceived)
+	if !ok {
+		t.Fatalf("Failed to receive request body")
+	}
+	ExpectEqual(t, "FooBar", string(msg.Body))
+	ExpectEqual(t, "HTTP/1.1 100 Continue\r\n\r\n", w.String())
+
+	// and never with a rejection
+	w = new(bytes.Buffer)
+	h = NewClientHandler(strings.NewReader(req), w)
+	ch = h.Start()
+	<-ch
+	ch <- &ResponseHeaderReceived{ResponseBadRequest}
+	ch <- &ResponseBodyReceived{nil, true}
+	<-ch // ClientDone
+	ExpectEqual(t, "HTTP/1.1 400 Bad Request\r\nConnection: close\r\n\r\n",
+		w.String())
+}
+
+func TestServerHandlerRequestBody(t *testing.T) {
+	r := strings.NewReader("HTTP/1.1 204 No Content\r\n\r\n")
+	w := new(bytes.Buffer)
+	h := NewServerHandler(r, w)
+
+	req := &Request{
+		Method:  "POST",
+		URI:     "/",
+		Version: "HTTP/1.1",
+		Headers: HTTPHeader{
+			{"Content-Length", "6"},
+		},
+	}
+	ch := h.Start(req)
+	ch <- &RequestBodyReceived{[]byte("Foo"), false}
+	ch <- &RequestBodyReceived{[]byte("Bar"), true}
+
+	if _, ok := (<-ch).(*ResponseHeaderReceived); !ok {
+		t.Fatalf("Failed to receive response header")
+	}
+	expect := "POST / HTTP/1.1\r\nContent-Length: 6\r\n\r\nFooBar"
+	ExpectEqual(t, expect, w.String())
+}
+
+func TestClientHandlerKeepAlive(t *testing.T) {
+	ss := []string{
+		"GET /1 HTTP/1.1\r\nHost: localhost\r\n\r\n",
+		"GET /2 HTTP/1.0\r\nConnection: keep-alive\r\n\r\n",
+		"GET /3 HTTP/1.0\r\n\r\n",
+	}
+	r := strings.NewReader(strings.Join(ss, ""))
+	w := new(bytes.Buffer)
+	h := NewClientHandler(r, w)
+	h.h.timeouts.KeepAlive = 15 * time.Second
+
+	res := &Response{
+		Version: "HTTP/1.1",
+		Status:  200,
+		Phrase:  "OK",
+		Headers: HTTPHeader{
+			{"Content-Length", "3"},
+		},
+	}
+	for i, keepAlive := range []bool{true, true, false} {
+		if err := h.WaitForRequest(); err != nil {
+			t.Fatalf("Failed to wait for request %d: %v", i, err)
+		}
+		ch := h.Start()
+		msg, ok := (<-ch).(*RequestHeaderReceived)
+		if !ok {
+			t.Fatalf("Failed to receive request header %d", i)
+		}
+		ExpectEqual(t, "/"+strconv.Itoa(i+1), msg.Req.URI)
+		ch <- &ResponseHeaderReceived{res}
+		ch <- &ResponseBodyReceived{[]byte("Foo"), true}
+		<-ch // ClientDone
+		if h.KeepAlive() != keepAlive {
+			t.Errorf("KeepAlive() = %t for request %d", !keepAlive, i)
+		}
+	}
+	if !strings.Contains(w.String(), "Keep-Alive: timeout=") {
+		t.Errorf("No Keep-Alive header for HTTP/1.0 client")
+	}
+}
+
+func TestClientHandlerTimeout(t *testing.T) {
+	conn, peer := net.Pipe()
+	defer conn.Close()
+	defer peer.Close()
+	h := NewClientHandler(conn, conn)
+	h.SetTimeouts(conn, Timeouts{Header: 10 * time.Millisecond})
+
+	ch := h.Start()
+	go peer.Write([]byte("GET / HTTP/1.1\r\n"))
+
+	msg, ok := (<-ch).(*ErrorOccurred)
+	if !ok {
+		t.Fatalf("Failed to receive error")
+	}
+	if !isTimeout(msg.Error) {
+		t.Errorf("Got %v, want timeout", msg.Error)
+	}
+}
+
+func TestServerHandlerTimeout(t *testing.T) {
+	conn, peer := net.Pipe()
+	defer conn.Close()
+	defer peer.Close()
+	h := NewServerHandler(conn, conn)
+	h.SetTimeouts(conn, Timeouts{Header: 10 * time.Millisecond}, time.Time{})
+
+	go io.Copy(io.Discard, peer)
+	ch := h.Start(&Request{Method: "GET", URI: "/", Version: "HTTP/1.1"})
+
+	msg, ok := (<-ch).(*ErrorOccurred)
+	if !ok {
+		t.Fatalf("Failed to receive error")
+	}
+	if !isTimeout(msg.Error) {
+		t.Errorf("Got %v, want timeout", msg.Error)
+	}
+	h.Stop()
+}
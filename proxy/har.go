@@ -0,0 +1,410 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// HARConfig selects the traffic recorded to a HAR file.
+type HARConfig struct {
+	// File written on SIGHUP and at exit, or "" not to record
+	Path string `json:"path"`
+	// Bytes of each body recorded, where the rest is cut off
+	MaxBody int64 `json:"max_body"`
+	// Oldest entries are dropped over this
+	MaxEntries int `json:"max_entries"`
+	// Globs of hosts recorded, or all if empty
+	Hosts []string `json:"hosts"`
+	// Prefixes of response media types recorded like "text/", or all if
+	// empty
+	ContentTypes []string `json:"content_types"`
+}
+
+func (c *HARConfig) validate() error {
+	if c.MaxBody < 0 {
+		return fmt.Errorf("har.max_body: must not be negative")
+	}
+	if c.MaxEntries <= 0 {
+		return fmt.Errorf("har.max_entries: must be positive")
+	}
+	for _, pattern := range c.Hosts {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("har.hosts: invalid pattern %q", pattern)
+		}
+	}
+	return nil
+}
+
+// HAR 1.2 (http://www.softwareishard.com/blog/har-12-spec/)
+type harLog struct {
+	Log harLogBody `json:"log"`
+}
+
+type harLogBody struct {
+	Version string      `json:"version"`
+	Creator harCreator  `json:"creator"`
+	Entries []*harEntry `json:"entries"`
+}
+
+type harCreator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type harEntry struct {
+	StartedDateTime string      `json:"startedDateTime"`
+	Time            float64     `json:"time"`
+	Request         harRequest  `json:"request"`
+	Response        harResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         harTimings  `json:"timings"`
+	ServerIPAddress string      `json:"serverIPAddress,omitempty"`
+}
+
+type harNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type harRequest struct {
+	Method      string         `json:"method"`
+	URL         string         `json:"url"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	QueryString []harNameValue `json:"queryString"`
+	PostData    *harPostData   `json:"postData,omitempty"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int64          `json:"bodySize"`
+}
+
+type harPostData struct {
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+	Encoding string `json:"encoding,omitempty"`
+	Comment  string `json:"comment,omitempty"`
+}
+
+type harResponse struct {
+	Status      int            `json:"status"`
+	StatusText  string         `json:"statusText"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	Content     harContent     `json:"content"`
+	RedirectURL string         `json:"redirectURL"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int64          `json:"bodySize"`
+}
+
+type harContent struct {
+	Size     int64  `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text,omitempty"`
+	Encoding string `json:"encoding,omitempty"`
+	Comment  string `json:"comment,omitempty"`
+}
+
+// Milliseconds, or -1 if not applicable
+type harTimings struct {
+	Blocked float64 `json:"blocked"`
+	DNS     float64 `json:"dns"`
+	Connect float64 `json:"connect"`
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+	SSL     float64 `json:"ssl"`
+}
+
+// harRedacted replaces the credentials of the client to the proxy, as HAR
+// files are shared.
+const harRedacted = "[redacted]"
+
+func harHeaders(h HTTPHeader) []harNameValue {
+	fields := make([]harNameValue, 0, len(h))
+	for _, f := range h {
+		v := f.Value
+		if strings.EqualFold(f.Name, "proxy-authorization") {
+			v = harRedacted
+		}
+		fields = append(fields, harNameValue{f.Name, v})
+	}
+	return fields
+}
+
+// harQueryString splits the query of uri in order.
+func harQueryString(uri string) []harNameValue {
+	fields := []harNameValue{}
+	pos := strings.Index(uri, "?")
+	if pos == -1 {
+		return fields
+	}
+	for _, param := range strings.Split(uri[pos+1:], "&") {
+		if param == "" {
+			continue
+		}
+		name, value, _ := strings.Cut(param, "=")
+		if v, err := url.QueryUnescape(name); err == nil {
+			name = v
+		}
+		if v, err := url.QueryUnescape(value); err == nil {
+			value = v
+		}
+		fields = append(fields, harNameValue{name, value})
+	}
+	return fields
+}
+
+func harMillis(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+// harBody is a body recorded up to a limit.
+type harBody struct {
+	b    []byte
+	size int64
+	max  int64
+}
+
+func (b *harBody) write(p []byte) {
+	b.size += int64(len(p))
+	if n := b.max - int64(len(b.b)); n > 0 {
+		if int64(len(p)) > n {
+			p = p[:n]
+		}
+		b.b = append(b.b, p...)
+	}
+}
+
+// text returns the body as text, or base64 if it's not UTF-8, and a
+// comment if it's been cut off.
+func (b *harBody) text() (text, encoding, comment string) {
+	if b.size > int64(len(b.b)) {
+		comment = fmt.Sprintf("Cut off at %d of %d bytes", len(b.b), b.size)
+	}
+	if utf8.Valid(b.b) {
+		return string(b.b), "", comment
+	}
+	return base64.StdEncoding.EncodeToString(b.b), "base64", comment
+}
+
+// A harCapture records a transaction. Its methods do nothing if it's nil,
+// which is the case when it's not recorded.
+type harCapture struct {
+	req     *Request
+	reqBody harBody
+	res     *Response
+	resBody harBody
+	// Time spent connecting to the server
+	connect time.Duration
+	// When the response header was sent to the client
+	resTime time.Time
+}
+
+func (c *harCapture) addRequestBody(b []byte) {
+	if c != nil {
+		c.reqBody.write(b)
+	}
+}
+
+func (c *harCapture) setResponse(res *Response) {
+	if c != nil {
+		c.res = res
+		c.resTime = time.Now()
+	}
+}
+
+func (c *harCapture) addResponseBody(b []byte) {
+	if c != nil {
+		c.resBody.write(b)
+	}
+}
+
+func (c *harCapture) setConnect(d time.Duration) {
+	if c != nil {
+		c.connect = d
+	}
+}
+
+// A HARRecorder keeps the latest transactions, and writes them to a HAR
+// file when flushed. It isn't written periodically, as the whole log would
+// be marshalled each time.
+type HARRecorder struct {
+	config HARConfig
+
+	mu      sync.Mutex
+	entries []*harEntry
+}
+
+func NewHARRecorder(config HARConfig) (*HARRecorder, error) {
+	r := &HARRecorder{config: config}
+	// Fails early if the file can't be written
+	if err := r.Flush(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Flush writes the file, replacing it at once so that it's always whole.
+func (r *HARRecorder) Flush() error {
+	r.mu.Lock()
+	h := harLog{harLogBody{
+		Version: "1.2",
+		Creator: harCreator{"go-proxy", "1.0"},
+		Entries: append([]*harEntry{}, r.entries...),
+	}}
+	r.mu.Unlock()
+
+	b, err := json.MarshalIndent(h, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(filepath.Dir(r.config.Path),
+		"."+filepath.Base(r.config.Path)+".tmp")
+	if err := os.WriteFile(tmp, b, 0644); err != nil {
+		return fmt.Errorf("Failed to write HAR: %w", err)
+	}
+	if err := os.Rename(tmp, r.config.Path); err != nil {
+		return fmt.Errorf("Failed to write HAR: %w", err)
+	}
+	return nil
+}
+
+// Close writes the file for the last time.
+func (r *HARRecorder) Close() error {
+	return r.Flush()
+}
+
+// capture starts recording a transaction of req, unless its host is
+// filtered out.
+func (r *HARRecorder) capture(req *Request) *harCapture {
+	if r == nil {
+		return nil
+	}
+	if len(r.config.Hosts) > 0 {
+		host := req.TargetHost()
+		if req.Method == "CONNECT" {
+			host = req.Authority
+		}
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		host = strings.ToLower(host)
+		matched := false
+		for _, pattern := range r.config.Hosts {
+			if ok, _ := path.Match(pattern, host); ok {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return nil
+		}
+	}
+	return &harCapture{
+		req:     req,
+		reqBody: harBody{max: r.config.MaxBody},
+		resBody: harBody{max: r.config.MaxBody},
+	}
+}
+
+// matchesContentType reports whether a response of mediaType is recorded.
+func (r *HARRecorder) matchesContentType(mediaType string) bool {
+	if len(r.config.ContentTypes) == 0 {
+		return true
+	}
+	for _, prefix := range r.config.ContentTypes {
+		if mediaType != "" && strings.HasPrefix(mediaType, strings.ToLower(prefix)) {
+			return true
+		}
+	}
+	return false
+}
+
+// add records a transaction that has ended, where sentTime is when the
+// request was sent to the server or zero if it wasn't.
+func (r *HARRecorder) add(c *harCapture, access *accessLogEntry,
+	sentTime time.Time) {
+	if r == nil || c == nil || c.res == nil {
+		return
+	}
+	mimeType := c.res.Headers.Get("content-type")
+	mediaType, _, _ := strings.Cut(mimeType, ";")
+	if !r.matchesContentType(strings.ToLower(strings.TrimSpace(mediaType))) {
+		return
+	}
+
+	req := c.req
+	u := req.URI
+	if req.Method == "CONNECT" {
+		u = req.Authority
+	} else if req.Authority == "" {
+		u = "http://" + req.TargetHost() + req.URI
+	}
+	e := &harEntry{
+		StartedDateTime: access.Time.Format("2006-01-02T15:04:05.000Z07:00"),
+		Time:            harMillis(access.Duration),
+		Request: harRequest{
+			Method:      req.Method,
+			URL:         u,
+			HTTPVersion: req.Version,
+			Cookies:     []harNameValue{},
+			Headers:     harHeaders(req.Headers),
+			QueryString: harQueryString(req.URI),
+			HeadersSize: -1,
+			BodySize:    c.reqBody.size,
+		},
+		Response: harResponse{
+			Status:      c.res.Status,
+			StatusText:  c.res.Phrase,
+			HTTPVersion: c.res.Version,
+			Cookies:     []harNameValue{},
+			Headers:     harHeaders(c.res.Headers),
+			RedirectURL: c.res.Headers.Get("location"),
+			HeadersSize: -1,
+			BodySize:    c.resBody.size,
+		},
+	}
+	if c.reqBody.size > 0 {
+		pd := &harPostData{MimeType: req.Headers.Get("content-type")}
+		pd.Text, pd.Encoding, pd.Comment = c.reqBody.text()
+		e.Request.PostData = pd
+	}
+	e.Response.Content = harContent{Size: c.resBody.size, MimeType: mimeType}
+	content := &e.Response.Content
+	content.Text, content.Encoding, content.Comment = c.resBody.text()
+	if host, _, err := net.SplitHostPort(access.Upstream); err == nil {
+		e.ServerIPAddress = host
+	}
+
+	// Time before sending the request, which is spent on checks and the
+	// cache besides connecting, is blocked
+	end := access.Time.Add(access.Duration)
+	tm := harTimings{DNS: -1, Connect: -1, SSL: -1}
+	if sentTime.IsZero() {
+		tm.Wait = harMillis(c.resTime.Sub(access.Time))
+	} else {
+		tm.Blocked = harMillis(sentTime.Sub(access.Time) - c.connect)
+		tm.Connect = harMillis(c.connect)
+		tm.Wait = harMillis(c.resTime.Sub(sentTime))
+	}
+	tm.Receive = harMillis(end.Sub(c.resTime))
+	e.Timings = tm
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.entries = append(r.entries, e)
+	if n := len(r.entries) - r.config.MaxEntries; n > 0 {
+		r.entries = r.entries[n:]
+	}
+}
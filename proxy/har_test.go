@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestHARBody(t *testing.T) {
+	b := harBody{max: 4}
+	b.write([]byte("abc"))
+	b.write([]byte("def"))
+	text, encoding, comment := b.text()
+	ExpectEqual(t, "abcd", text)
+	ExpectEqual(t, "", encoding)
+	ExpectEqual(t, "Cut off at 4 of 6 bytes", comment)
+
+	b = harBody{max: 10}
+	b.write([]byte{0xff, 0xfe})
+	text, encoding, _ = b.text()
+	ExpectEqual(t, "//4=", text)
+	ExpectEqual(t, "base64", encoding)
+}
+
+func TestHARRecorder(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "proxy.har")
+	r, err := NewHARRecorder(HARConfig{
+		Path:         path,
+		MaxBody:      3,
+		MaxEntries:   10,
+		Hosts:        []string{"127.0.0.1"},
+		ContentTypes: []string{"text/"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	withSettings(t, func(st *settings) { st.har = r })
+
+	// Origin answering /json with JSON, and others with text
+	ln, accepted := listen(t)
+	defer ln.Close()
+	go func() {
+		for conn := range accepted {
+			go func(conn net.Conn) {
+				defer conn.Close()
+				br := bufio.NewReader(conn)
+				lines := readTestRequestHeader(br)
+				typ := "text/plain"
+				if strings.Contains(lines[0], "/json") {
+					typ = "application/json"
+				}
+				for _, line := range lines {
+					if v, ok := strings.CutPrefix(line, "Content-Length: "); ok {
+						n, _ := strconv.Atoi(v)
+						io.CopyN(io.Discard, br, int64(n))
+					}
+				}
+				io.WriteString(conn, "HTTP/1.1 200 OK\r\nContent-Type: "+typ+
+					"\r\nContent-Length: 5\r\n\r\nhello")
+			}(conn)
+		}
+	}()
+
+	// Connections are served until closed by the client
+	serve := func() (net.Conn, chan struct{}) {
+		conn, peer := net.Pipe()
+		done := make(chan struct{})
+		go func() {
+			handle(conn)
+			close(done)
+		}()
+		return peer, done
+	}
+	peer, done := serve()
+	br := bufio.NewReader(peer)
+	origin := "http://" + ln.Addr().String()
+	go io.WriteString(peer, "POST "+origin+"/a?x=1&y=%20 HTTP/1.1\r\n"+
+		"Proxy-Authorization: Basic YWxpY2U6c2VjcmV0\r\n"+
+		"Content-Type: text/plain\r\nContent-Length: 4\r\n\r\nping")
+	readTestResponse(t, br)
+	go io.WriteString(peer, "GET "+origin+"/json HTTP/1.1\r\n\r\n")
+	readTestResponse(t, br)
+	peer.Close()
+	<-done
+	// Another host
+	peer, done = serve()
+	go io.WriteString(peer, "GET http://localhost:"+
+		strconv.Itoa(ln.Addr().(*net.TCPAddr).Port)+"/ HTTP/1.1\r\n\r\n")
+	readTestResponse(t, bufio.NewReader(peer))
+	peer.Close()
+	<-done
+
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(b), "YWxpY2U6c2VjcmV0") {
+		t.Errorf("Credentials were recorded")
+	}
+	var h harLog
+	if err := json.Unmarshal(b, &h); err != nil {
+		t.Fatal(err)
+	}
+	ExpectEqual(t, "1.2", h.Log.Version)
+	if len(h.Log.Entries) != 1 {
+		t.Fatalf("Unexpected entries: %s", b)
+	}
+	e := h.Log.Entries[0]
+	ExpectEqual(t, "POST", e.Request.Method)
+	ExpectEqual(t, origin+"/a?x=1&y=%20", e.Request.URL)
+	ExpectEqual(t, "x=1,y= ", e.Request.QueryString[0].Name+"="+
+		e.Request.QueryString[0].Value+","+e.Request.QueryString[1].Name+"="+
+		e.Request.QueryString[1].Value)
+	ExpectEqual(t, "pin", e.Request.PostData.Text)
+	auth := ""
+	for _, f := range e.Request.Headers {
+		if f.Name == "Proxy-Authorization" {
+			auth = f.Value
+		}
+	}
+	ExpectEqual(t, harRedacted, auth)
+	ExpectEqual(t, "4", strconv.FormatInt(e.Request.BodySize, 10))
+	ExpectEqual(t, "200", strconv.Itoa(e.Response.Status))
+	ExpectEqual(t, "hel", e.Response.Content.Text)
+	ExpectEqual(t, "5", strconv.FormatInt(e.Response.Content.Size, 10))
+	ExpectEqual(t, "127.0.0.1", e.ServerIPAddress)
+	tm := e.Timings
+	sum := tm.Blocked + tm.Connect + tm.Send + tm.Wait + tm.Receive
+	if d := sum - e.Time; d > 0.01 || d < -0.01 {
+		t.Errorf("Timings add up to %f, not %f", sum, e.Time)
+	}
+}
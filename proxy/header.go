@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// A HeaderField is a header line with the name as received.
+type HeaderField struct {
+	Name  string
+	Value string
+}
+
+// HTTPHeader keeps header fields in the received order, with the original
+// case of names and repeated fields like Set-Cookie. Names are looked up
+// case-insensitively.
+type HTTPHeader []HeaderField
+
+// Get returns the first value of the field name, or "" if there's none.
+func (h HTTPHeader) Get(name string) string {
+	for _, f := range h {
+		if strings.EqualFold(f.Name, name) {
+			return f.Value
+		}
+	}
+	return ""
+}
+
+func (h HTTPHeader) Has(name string) bool {
+	for _, f := range h {
+		if strings.EqualFold(f.Name, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// Values returns all the values of the field name in order.
+func (h HTTPHeader) Values(name string) []string {
+	var vs []string
+	for _, f := range h {
+		if strings.EqualFold(f.Name, name) {
+			vs = append(vs, f.Value)
+		}
+	}
+	return vs
+}
+
+// Joined returns the values of a comma-separated list field, which may be
+// split over several lines, as a single value.
+func (h HTTPHeader) Joined(name string) string {
+	return strings.Join(h.Values(name), ", ")
+}
+
+func (h *HTTPHeader) Add(name, value string) {
+	*h = append(*h, HeaderField{name, value})
+}
+
+// Set replaces the first field name with value and removes the others. The
+// field is added at the end if there's none.
+func (h *HTTPHeader) Set(name, value string) {
+	fs := (*h)[:0]
+	set := false
+	for _, f := range *h {
+		if strings.EqualFold(f.Name, name) {
+			if set {
+				continue
+			}
+			f.Value = value
+			set = true
+		}
+		fs = append(fs, f)
+	}
+	*h = fs
+	if !set {
+		h.Add(name, value)
+	}
+}
+
+func (h *HTTPHeader) Del(name string) {
+	fs := (*h)[:0]
+	for _, f := range *h {
+		if !strings.EqualFold(f.Name, name) {
+			fs = append(fs, f)
+		}
+	}
+	*h = fs
+}
+
+// Clone returns a copy that can be modified without changing h.
+func (h HTTPHeader) Clone() HTTPHeader {
+	if h == nil {
+		return nil
+	}
+	return append(HTTPHeader{}, h...)
+}
+
+// Write writes the fields followed by the empty line ending a header.
+func (h HTTPHeader) Write(w io.Writer) error {
+	var b strings.Builder
+	for _, f := range h {
+		fmt.Fprintf(&b, "%s: %s\r\n", f.Name, f.Value)
+	}
+	b.WriteString("\r\n")
+	_, err := io.WriteString(w, b.String())
+	return err
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestReadHeaders(t *testing.T) {
+	ss := []string{
+		"Set-Cookie: a=1\r\n",
+		"X-Folded: foo\r\n",
+		"  bar\r\n",
+		"set-cookie: b=2\r\n",
+		"Connection: keep-alive\r\n",
+		"Connection: Upgrade\r\n",
+		"\r\n",
+	}
+	h := BaseHandler{r: bufio.NewReader(strings.NewReader(strings.Join(ss, "")))}
+	headers, err := h.ReadHeaders()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ExpectEqual(t, "a=1", headers.Get("SET-COOKIE"))
+	ExpectEqual(t, "a=1|b=2", strings.Join(headers.Values("set-cookie"), "|"))
+	ExpectEqual(t, "foo bar", headers.Get("x-folded"))
+	ExpectEqual(t, "keep-alive, Upgrade", headers.Joined("connection"))
+
+	w := new(bytes.Buffer)
+	headers.Write(w)
+	expect := "Set-Cookie: a=1\r\nX-Folded: foo bar\r\nset-cookie: b=2\r\n" +
+		"Connection: keep-alive\r\nConnection: Upgrade\r\n\r\n"
+	ExpectEqual(t, expect, w.String())
+}
+
+func TestHTTPHeaderSetDel(t *testing.T) {
+	h := HTTPHeader{
+		{"Host", "a"},
+		{"Via", "1.1 x"},
+		{"host", "b"},
+	}
+	orig := h.Clone()
+	h.Set("HOST", "c")
+	h.Set("Accept", "*/*")
+	h.Del("via")
+
+	w := new(bytes.Buffer)
+	h.Write(w)
+	ExpectEqual(t, "Host: c\r\nAccept: */*\r\n\r\n", w.String())
+	ExpectEqual(t, "a", orig.Get("host"))
+	if h.Has("via") || !orig.Has("via") {
+		t.Errorf("Del() changed the clone or kept the field")
+	}
+}
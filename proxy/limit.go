@@ -0,0 +1,212 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Limits on clients, where zero means unlimited.
+type Limits struct {
+	// Requests per second from each client IP, with bursts up to Burst
+	Rate  float64 `json:"rate"`
+	Burst int     `json:"burst"`
+	// Concurrent connections from each client IP, and in total
+	MaxConnsPerClient int `json:"max_conns_per_client"`
+	MaxConns          int `json:"max_conns"`
+}
+
+// A Limiter applies Limits to clients.
+type Limiter struct {
+	limits Limits
+
+	mu        sync.Mutex
+	clients   map[string]*clientLimit
+	conns     int
+	lastSweep time.Time
+}
+
+type clientLimit struct {
+	// Token bucket of requests
+	tokens float64
+	last   time.Time
+	conns  int
+}
+
+// limiter limits nothing until the config sets its limits.
+var limiter = NewLimiter(Limits{})
+
+// Idle clients are forgotten at this interval
+const limiterSweepInterval = time.Minute
+
+func NewLimiter(limits Limits) *Limiter {
+	l := &Limiter{
+		clients:   make(map[string]*clientLimit),
+		lastSweep: time.Now(),
+	}
+	l.SetLimits(limits)
+	return l
+}
+
+// SetLimits changes the limits, keeping the connections and requests
+// counted so far.
+func (l *Limiter) SetLimits(limits Limits) {
+	if limits.Burst < 1 {
+		limits.Burst = 1
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.limits = limits
+}
+
+// client must be called with l.mu held.
+func (l *Limiter) client(ip string, now time.Time) *clientLimit {
+	c, ok := l.clients[ip]
+	if !ok {
+		c = &clientLimit{tokens: float64(l.limits.Burst), last: now}
+		l.clients[ip] = c
+	}
+	// Refill
+	c.tokens += now.Sub(c.last).Seconds() * l.limits.Rate
+	if c.tokens > float64(l.limits.Burst) {
+		c.tokens = float64(l.limits.Burst)
+	}
+	c.last = now
+	return c
+}
+
+// sweep removes clients without connections and with full buckets, which
+// are the same as unknown ones. It must be called with l.mu held.
+func (l *Limiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < limiterSweepInterval {
+		return
+	}
+	l.lastSweep = now
+	for ip, c := range l.clients {
+		full := l.limits.Rate == 0 || c.tokens+
+			now.Sub(c.last).Seconds()*l.limits.Rate >= float64(l.limits.Burst)
+		if c.conns == 0 && full {
+			delete(l.clients, ip)
+		}
+	}
+}
+
+// acquireConn reports whether a connection from ip is allowed, and counts
+// it if so. It must be released by releaseConn.
+func (l *Limiter) acquireConn(ip string) bool {
+	if l == nil {
+		return true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	l.sweep(now)
+	if l.limits.MaxConns > 0 && l.conns >= l.limits.MaxConns {
+		return false
+	}
+	c := l.client(ip, now)
+	max := l.limits.MaxConnsPerClient
+	if max > 0 && c.conns >= max {
+		return false
+	}
+	c.conns++
+	l.conns++
+	return true
+}
+
+func (l *Limiter) releaseConn(ip string) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if c, ok := l.clients[ip]; ok && c.conns > 0 {
+		c.conns--
+		l.conns--
+	}
+}
+
+// allowRequest takes a token for a request from ip. If there's none, it
+// returns false and how long to wait for one.
+func (l *Limiter) allowRequest(ip string) (bool, time.Duration) {
+	if l == nil {
+		return true, 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.limits.Rate == 0 {
+		return true, 0
+	}
+	c := l.client(ip, time.Now())
+	if c.tokens >= 1 {
+		c.tokens--
+		return true, 0
+	}
+	wait := (1 - c.tokens) / l.limits.Rate
+	return false, time.Duration(wait * float64(time.Second))
+}
+
+// clientIP returns the IP address in addr, or addr itself if it has none.
+func clientIP(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+// tooManyRequestsResponse returns 429 telling to retry after wait.
+func tooManyRequestsResponse(wait time.Duration) (*Response, []byte) {
+	body := []byte("Too many requests\n")
+	res := &Response{
+		Version: "HTTP/1.1",
+		Status:  429,
+		Phrase:  "Too Many Requests",
+	}
+	seconds := int(math.Ceil(wait.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	res.Headers.Add("Retry-After", strconv.Itoa(seconds))
+	res.Headers.Add("Content-Type", "text/plain; charset=utf-8")
+	res.Headers.Add("Content-Length", strconv.Itoa(len(body)))
+	return res, body
+}
+
+// Connections being answered by rejectConn, whose number is bounded so
+// that a flood over the limits doesn't hold sockets
+var rejecting = make(chan struct{}, 16)
+
+// rejectConn replies 429 to a connection over the limits without reading
+// the request, and closes it. The connection is closed right away if too
+// many are being answered already.
+func rejectConn(conn net.Conn) {
+	select {
+	case rejecting <- struct{}{}:
+	default:
+		conn.Close()
+		return
+	}
+	go func() {
+		defer func() { <-rejecting }()
+		replyTooManyConns(conn)
+	}()
+}
+
+func replyTooManyConns(conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	res, body := tooManyRequestsResponse(time.Second)
+	res.Headers.Add("Connection", "close")
+	fmt.Fprintf(conn, "%s %d %s\r\n", res.Version, res.Status, res.Phrase)
+	res.Headers.Write(conn)
+	conn.Write(body)
+	// Closing with the request unread could make the client miss the
+	// response
+	closeWrite(conn)
+	io.Copy(io.Discard, io.LimitReader(conn, 64*1024))
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestLimiterRate(t *testing.T) {
+	l := NewLimiter(Limits{Rate: 2, Burst: 2})
+	for i := 0; i < 2; i++ {
+		if ok, _ := l.allowRequest("192.0.2.1"); !ok {
+			t.Fatalf("Request %d in burst was limited", i)
+		}
+	}
+	ok, wait := l.allowRequest("192.0.2.1")
+	if ok || wait <= 0 || wait > 500*time.Millisecond {
+		t.Errorf("Unexpected result over burst: %v %v", ok, wait)
+	}
+	// Others have their own buckets
+	if ok, _ := l.allowRequest("192.0.2.2"); !ok {
+		t.Errorf("Another client was limited")
+	}
+	time.Sleep(wait)
+	if ok, _ := l.allowRequest("192.0.2.1"); !ok {
+		t.Errorf("Request after waiting was limited")
+	}
+
+	res, _ := tooManyRequestsResponse(wait)
+	ExpectEqual(t, "1", res.Headers.Get("retry-after"))
+}
+
+func TestLimiterConns(t *testing.T) {
+	l := NewLimiter(Limits{MaxConnsPerClient: 1, MaxConns: 2})
+	if !l.acquireConn("192.0.2.1") {
+		t.Fatal("First connection was limited")
+	}
+	if l.acquireConn("192.0.2.1") {
+		t.Errorf("Connections per client weren't limited")
+	}
+	if !l.acquireConn("192.0.2.2") {
+		t.Errorf("Another client was limited")
+	}
+	if l.acquireConn("192.0.2.3") {
+		t.Errorf("Connections in total weren't limited")
+	}
+	l.releaseConn("192.0.2.1")
+	if !l.acquireConn("192.0.2.3") {
+		t.Errorf("Released connection was still counted")
+	}
+
+	var nl *Limiter
+	if !nl.acquireConn("192.0.2.1") {
+		t.Errorf("nil Limiter limited a connection")
+	}
+}
+
+func TestRejectConn(t *testing.T) {
+	var peers []net.Conn
+	defer func() {
+		for _, peer := range peers {
+			peer.Close()
+		}
+		for len(rejecting) > 0 {
+			time.Sleep(time.Millisecond)
+		}
+	}()
+	// Clients not reading the responses hold the rejecters
+	for i := 0; i < cap(rejecting); i++ {
+		conn, peer := net.Pipe()
+		peers = append(peers, peer)
+		rejectConn(conn)
+	}
+	conn, peer := net.Pipe()
+	defer peer.Close()
+	rejectConn(conn)
+	peer.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := peer.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("Connection over the rejecters wasn't closed: %v", err)
+	}
+
+	status, _ := bufio.NewReader(peers[0]).ReadString('\n')
+	ExpectEqual(t, "HTTP/1.1 429 Too Many Requests\r\n", status)
+}
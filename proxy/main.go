@@ -1,11 +1,17 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
 	"log"
 	"net"
+	"os"
+	"os/signal"
 	"strconv"
 	"strings"
+	"syscall"
+	"time"
 )
 
 func waitForRequestHeader(ch chan interface{}) (*Request, error) {
@@ -21,7 +27,6 @@ func waitForRequestHeader(ch chan interface{}) (*Request, error) {
 }
 
 func appendPortIfNeeded(h string) string {
-	// TODO: support https
 	pos := strings.LastIndex(h, ":")
 	if pos == -1 {
 		return h + ":80"
@@ -33,112 +38,561 @@ func appendPortIfNeeded(h string) string {
 	return h
 }
 
-func dialForRequest(req *Request) (net.Conn, error) {
-	host, ok := req.Headers["host"]
-	if !ok {
-		return nil, fmt.Errorf("No Host header")
+// Idle connections to servers, replaced by the config in main
+var upstreamPool = NewConnPool(4, 90*time.Second, 10*time.Second)
+
+// dialForRequest returns a connection to the server of req, or to the
+// parent proxy chosen by rules if it's not nil.
+func dialForRequest(
+	req *Request, rules *UpstreamRules) (*upstreamConn, *parentProxy, error) {
+	host := req.TargetHost()
+	if host == "" {
+		return nil, nil, fmt.Errorf("No Host header")
 	}
 	addr := appendPortIfNeeded(host)
-	conn, err := net.Dial("tcp", addr)
+	if parent := rules.parentFor(addr); parent != nil {
+		c, err := upstreamPool.Get(parent.addr)
+		return c, parent, err
+	}
+	c, err := upstreamPool.Get(addr)
+	return c, nil, err
+}
+
+// releaseConn returns svConn to the pool if sv has read the whole response,
+// which ended is true after, and left it reusable.
+func releaseConn(svConn *upstreamConn, sv *ServerHandler, ended bool) {
+	if ended && sv.Reusable() {
+		upstreamPool.Put(svConn)
+	} else {
+		svConn.Close()
+	}
+}
+
+// A transaction is a request from a client and its response, relayed
+// between a ClientHandler and a ServerHandler.
+type transaction struct {
+	// Settings when the request started
+	st     *settings
+	cl     *ClientHandler
+	sv     *ServerHandler
+	clChan chan interface{}
+	svChan chan interface{}
+	req    *Request
+	// nil if the response isn't from or to the cache
+	cx *cacheExchange
+	// Stored response sent instead of the server's after validation
+	cached *cacheEntry
+	// Whether a response header has been sent to the client
+	responding bool
+	done       bool
+	// Whether the handlers have been stopped before the end
+	aborted bool
+	access  accessLogEntry
+	// Bytes of the request body received from the client
+	received int64
+	// When the request was sent to the server
+	sentTime time.Time
+	// Filters of the response by middlewares
+	filters []ResponseFilter
+	// nil if not recorded
+	capture *harCapture
+	// nil if the response isn't recorded as a fixture
+	recording *fixtureRecording
+	// Route and backend of a reverse-proxied request, or nil
+	route   *route
+	backend *backend
+	// Whether the server has switched the protocol with 101
+	upgraded bool
+	// Whether the end of the response has been received from the server
+	responseEnded bool
+}
+
+// sendHeader and sendBody send the response to the client.
+func (t *transaction) sendHeader(res *Response) {
+	t.responding = true
+	t.access.Status = res.Status
+	t.capture.setResponse(res)
+	t.clChan <- &ResponseHeaderReceived{res}
+}
+
+func (t *transaction) sendBody(b []byte, isEnd bool) {
+	t.access.Bytes += int64(len(b))
+	t.capture.addResponseBody(b)
+	t.clChan <- &ResponseBodyReceived{b, isEnd}
+}
+
+// forwardHeader and forwardBody send the response from the server or the
+// cache through the filters.
+func (t *transaction) forwardHeader(res *Response) {
+	for _, f := range t.filters {
+		res = f.Header(res)
+	}
+	t.sendHeader(res)
+}
+
+func (t *transaction) forwardBody(b []byte, isEnd bool) {
+	for _, f := range t.filters {
+		b = f.Body(b, isEnd)
+	}
+	// An empty chunk would end a chunked body
+	if len(b) == 0 && !isEnd {
+		return
+	}
+	t.sendBody(b, isEnd)
+}
+
+func (t *transaction) sendResponse(res *Response, body []byte) {
+	t.sendHeader(res)
+	t.sendBody(body, true)
+}
+
+func (t *transaction) sendErrorResponse(res *Response) {
+	t.sendResponse(res, nil)
+}
+
+// logAccess writes the access log entry, counts the request in the metrics
+// and records it when the transaction has ended. The current access log is
+// used, as the one when the request started may have been closed by a
+// reload.
+func (t *transaction) logAccess() {
+	t.access.Duration = time.Since(t.access.Time)
+	metrics.addRequest(&t.access, t.received)
+	t.st.har.add(t.capture, &t.access, t.sentTime)
+	accessLog := loadSettings().accessLog
+	if accessLog == nil {
+		return
+	}
+	accessLog.Log(&t.access)
+}
+
+// sendEntry sends a stored response to the client.
+func (t *transaction) sendEntry(e *cacheEntry) {
+	res := e.response(time.Now())
+	if t.cx.notModified(e) {
+		t.forwardHeader(notModifiedResponse(res))
+		t.forwardBody(nil, true)
+		return
+	}
+	t.forwardHeader(res)
+	err := t.cx.cache.readEntryBody(e, t.forwardBody)
 	if err != nil {
-		return nil, err
+		log.Println(err)
+		t.abort()
+	}
+}
+
+// wantBody makes the client handler read the request body, sending 100
+// Continue if the client waits for it. It's only called once the request
+// has been accepted.
+func (t *transaction) wantBody() {
+	if t.req.HasBody() {
+		t.clChan <- &BodyWanted{}
 	}
-	return conn, nil
 }
 
-func handleClientMessage(m interface{}, clChan, svChan chan interface{}) bool {
-	done := false
+// abort is called when nothing more can be sent to the client.
+func (t *transaction) abort() {
+	t.cl.Stop()
+	if t.sv != nil {
+		t.sv.Stop()
+	}
+	t.aborted = true
+	t.done = true
+}
+
+func (t *transaction) handleClientMessage(m interface{}) {
 	switch msg := m.(type) {
 	case *ClientDone:
 		log.Println("client done")
-		done = true
+		t.done = true
+	case *RequestBodyReceived:
+		log.Printf("request body received: n=%d\n", len(msg.Body))
+		t.received += int64(len(msg.Body))
+		t.capture.addRequestBody(msg.Body)
+		t.recording.addRequestBody(msg.Body, msg.IsEnd)
+		if t.sv != nil {
+			t.svChan <- msg
+		}
 	case *ErrorOccurred:
 		log.Println(msg.Error)
-		// TODO: helper function
-		clChan <- &ResponseHeaderReceived{ResponseBadRequest}
-		clChan <- &ResponseBodyReceived{nil, true}
+		if t.responding {
+			t.abort()
+			return
+		}
+		res := ResponseBadRequest
+		if isTimeout(msg.Error) {
+			res = ResponseRequestTimeout
+		}
+		t.sendErrorResponse(res)
 	default:
 		log.Printf("Unexpected message from client: %v\n", msg)
 		panic("")
 	}
-	return done
 }
 
-func handleServerMessage(m interface{}, clChan, svChan chan interface{}) bool {
+func (t *transaction) handleServerMessage(m interface{}) {
 	switch msg := m.(type) {
 	case *ResponseHeaderReceived:
 		log.Printf("response header received: status=%d\n", msg.Res.Status)
-		clChan <- msg
+		metrics.observeUpstreamLatency(time.Since(t.sentTime))
+		t.backend.succeeded()
+		t.upgraded = msg.Res.Status == 101
+		res := t.st.forwarding.forwardResponse(msg.Res)
+		t.recording.setResponse(res)
+		if t.cx != nil {
+			if e := t.cx.handleResponse(res); e != nil {
+				log.Printf("cache revalidated: %s\n", e.Key)
+				t.cached = e
+				return
+			}
+		} else if res.Status >= 200 && res.Status < 400 {
+			responseCache.invalidate(t.req)
+		}
+		t.forwardHeader(res)
 	case *ResponseBodyReceived:
 		log.Printf("response body received: n=%d\n", len(msg.Body))
-		clChan <- msg
+		t.responseEnded = msg.IsEnd
+		if t.cached != nil {
+			// The body of 304 is empty
+			if msg.IsEnd {
+				t.sendEntry(t.cached)
+			}
+			return
+		}
+		if t.cx != nil {
+			t.cx.writeBody(msg.Body, msg.IsEnd)
+		}
+		t.recording.addResponseBody(msg.Body, msg.IsEnd)
+		t.forwardBody(msg.Body, msg.IsEnd)
 	case *ErrorOccurred:
 		log.Println(msg.Error)
-		// TODO: helper function
-		clChan <- &ResponseHeaderReceived{ResponseInternalError}
-		clChan <- &ResponseBodyReceived{nil, true}
+		if t.backend != nil && !t.responding {
+			t.route.failed(t.backend)
+		}
+		if t.responding {
+			t.abort()
+			return
+		}
+		res := ResponseInternalError
+		if isTimeout(msg.Error) {
+			res = ResponseGatewayTimeout
+		}
+		t.sendErrorResponse(res)
 	default:
 		log.Printf("Unexpected message from server: %v\n", msg)
 		panic("")
 	}
-	return false
 }
 
+// wait relays messages until the client is done.
+func (t *transaction) wait() {
+	for !t.done {
+		select {
+		case msg := <-t.clChan:
+			t.handleClientMessage(msg)
+		case msg := <-t.svChan:
+			t.handleServerMessage(msg)
+		}
+	}
+}
+
+// handleRequest serves a request read by cl from conn, and reports whether
+// the client connection can be used for another request.
 // TODO: make this testable
-func handle(conn net.Conn) {
-	log.Printf("client connected: %s\n", conn.RemoteAddr().String())
-	defer conn.Close()
-	cl := NewClientHandler(conn, conn)
-	clChan := cl.Start()
-	// TODO: Do I need to stop cl?
+func handleRequest(cl *ClientHandler, conn net.Conn) bool {
+	st := loadSettings()
+	var deadline time.Time
+	if st.timeouts.Request > 0 {
+		deadline = time.Now().Add(st.timeouts.Request)
+	}
+	conn.SetWriteDeadline(deadline)
+	cl.SetDeadline(deadline)
+	t := &transaction{st: st, cl: cl, clChan: cl.Start()}
+	t.access.Time = time.Now()
+	t.access.Client = conn.RemoteAddr().String()
+	defer t.logAccess()
 
-	req, err := waitForRequestHeader(clChan)
+	req, err := waitForRequestHeader(t.clChan)
 	if err != nil {
 		log.Println(err)
-		return
+		res := ResponseBadRequest
+		if isTimeout(err) {
+			res = ResponseRequestTimeout
+		}
+		t.sendErrorResponse(res)
+		t.wait()
+		return false
 	}
 
-	svConn, err := dialForRequest(req)
+	t.access.setRequest(req)
+	t.capture = st.har.capture(req)
+	if ok, wait := limiter.allowRequest(clientIP(conn.RemoteAddr())); !ok {
+		log.Printf("rate limited: %s\n", conn.RemoteAddr().String())
+		t.sendResponse(tooManyRequestsResponse(wait))
+		t.wait()
+		return !t.aborted && cl.KeepAlive()
+	}
+	if st.acl != nil {
+		if ok, reason := st.acl.checkRequest(req, conn.RemoteAddr()); !ok {
+			log.Printf("denied: %s %s: %s\n", req.Method, req.URI, reason)
+			t.sendResponse(forbiddenResponse(reason))
+			t.wait()
+			return !t.aborted && cl.KeepAlive()
+		}
+	}
+	if st.auth != nil {
+		user := st.auth.authenticate(req)
+		if user == "" {
+			log.Printf("unauthenticated: %s %s\n", req.Method, req.URI)
+			t.sendResponse(proxyAuthRequiredResponse(st.authRealm))
+			t.wait()
+			return !t.aborted && cl.KeepAlive()
+		}
+		t.access.User = user
+	}
+	if req.Method == "CONNECT" {
+		// A reverse proxy isn't an open proxy
+		if st.routes != nil && !st.forwardProxy {
+			log.Printf("no route: %s %s\n", req.Method, req.URI)
+			t.sendResponse(noRouteResponse())
+			t.wait()
+			return false
+		}
+		if st.fixtures.replaying() {
+			log.Printf("tunnel refused in replay: %s\n", req.URI)
+			t.sendErrorResponse(ResponseBadGateway)
+			t.wait()
+			return false
+		}
+		handleConnect(t, req, conn, deadline)
+		return false
+	}
+
+	t.req = req
+	t.route = st.routes.match(req)
+	if t.route == nil && st.routes != nil &&
+		(req.Authority == "" || !st.forwardProxy) {
+		log.Printf("no route: %s %s\n", req.Method, req.URI)
+		t.sendResponse(noRouteResponse())
+		t.wait()
+		return !t.aborted && cl.KeepAlive()
+	}
+	out := st.forwarding.forwardRequest(req, conn.RemoteAddr())
+	if t.route != nil {
+		t.route.rewrite(out)
+	}
+	t.filters = st.middleware.request(out, conn.RemoteAddr())
+	upgrade := req.isUpgrade()
+	if st.fixtures.replaying() {
+		if upgrade {
+			log.Printf("upgrade refused in replay: %s\n", req.URI)
+			t.sendErrorResponse(ResponseBadGateway)
+			t.wait()
+			return false
+		}
+		t.replayFixture(st.fixtures, out)
+		return !t.aborted && cl.KeepAlive()
+	}
+	// Responses are recorded from the server rather than the cache, while
+	// upgraded connections are neither recorded nor cached
+	if !upgrade {
+		t.recording = st.fixtures.record(out)
+		if t.recording == nil {
+			t.cx = responseCache.newExchange(req)
+		}
+	}
+	if t.cx != nil {
+		defer t.cx.finish()
+		if t.cx.canServe(time.Now()) {
+			log.Printf("cache hit: %s\n", t.cx.key)
+			t.sendEntry(t.cx.entry)
+			t.wait()
+			return !t.aborted && cl.KeepAlive()
+		}
+		if t.cx.onlyIfCached() {
+			t.sendErrorResponse(ResponseGatewayTimeout)
+			t.wait()
+			return !t.aborted && cl.KeepAlive()
+		}
+	}
+
+	dialStart := time.Now()
+	var svConn *upstreamConn
+	var parent *parentProxy
+	if t.route != nil {
+		svConn, t.backend, err = t.route.dial(req, conn.RemoteAddr())
+		defer t.backend.release()
+	} else {
+		svConn, parent, err = dialForRequest(out, st.upstream)
+	}
+	t.capture.setConnect(time.Since(dialStart))
 	if err != nil {
 		log.Println(err)
-		return
+		metrics.addDialError()
+		res := ResponseBadGateway
+		if isTimeout(err) {
+			res = ResponseGatewayTimeout
+		} else if err == errNoBackend {
+			res = ResponseServiceUnavailable
+		}
+		t.sendErrorResponse(res)
+		t.wait()
+		return false
 	}
-	defer svConn.Close()
+	t.access.Upstream = svConn.RemoteAddr().String()
+	svConn.SetWriteDeadline(deadline)
+	t.sv = NewServerHandler(svConn.r, svConn)
+	t.sv.SetTimeouts(svConn, st.timeouts, deadline)
+	defer func() { releaseConn(svConn, t.sv, t.responseEnded) }()
+	defer t.sv.Stop()
 
-	sv := NewServerHandler(svConn, svConn)
+	if parent != nil {
+		parent.prepare(out, req)
+	}
+	if t.cx != nil {
+		t.cx.addConditionals(out)
+	}
+	t.sentTime = time.Now()
+	t.svChan = t.sv.Start(out)
+	t.wantBody()
+	t.wait()
+	if t.upgraded && !t.aborted {
+		t.relayUpgraded(conn, svConn.Conn)
+		return false
+	}
+	return !t.aborted && cl.KeepAlive()
+}
 
-	svChan := sv.Start(req)
+func handle(conn net.Conn) {
+	handleConn(conn, nil)
+}
 
-	// TODO: support timeout
-	// TODO: use a channel to break the loop
-	done := false
-	for !done {
-		select {
-		case msg := <-clChan:
-			done = handleClientMessage(msg, clChan, svChan)
-		case msg := <-svChan:
-			done = handleServerMessage(msg, clChan, svChan)
+// handleConn serves requests on conn until it's closed, or s is shut down
+// unless it's nil.
+func handleConn(conn net.Conn, s *Server) {
+	log.Printf("client connected: %s\n", conn.RemoteAddr().String())
+	defer conn.Close()
+	metrics.connOpened()
+	defer metrics.connClosed()
+	cl := NewClientHandler(conn, conn)
+	for {
+		if !s.setIdle(conn, true) {
+			return
+		}
+		// Reloaded settings apply from the next request
+		timeouts := loadSettings().timeouts
+		cl.SetTimeouts(conn, timeouts)
+		if timeouts.KeepAlive > 0 {
+			conn.SetReadDeadline(time.Now().Add(timeouts.KeepAlive))
+		}
+		if err := cl.WaitForRequest(); err != nil {
+			return
+		}
+		conn.SetReadDeadline(time.Time{})
+		s.setIdle(conn, false)
+		if !handleRequest(cl, conn) {
+			return
 		}
 	}
 }
 
-func Serve() {
-	port := "8080"
-	ln, err := net.Listen("tcp", ":"+port)
+// logPoolStats logs the stats of upstreamPool on SIGUSR1.
+func logPoolStats() {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGUSR1)
+	for range ch {
+		log.Printf("upstream pool: %v\n", upstreamPool.Stats())
+	}
+}
+
+// reloadOnHangup reloads the config on SIGHUP.
+func reloadOnHangup(path string) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	for range ch {
+		reload(path, flag.CommandLine)
+	}
+}
+
+func main() {
+	configPath := flag.String("config", "",
+		"JSON file of the config, overridden by the other flags")
+	defineFlags(flag.CommandLine, defaultConfig())
+	flag.Parse()
+
+	cfg, err := loadConfig(*configPath, flag.CommandLine)
 	if err != nil {
-		panic(err)
+		log.Fatal(err)
 	}
-	defer ln.Close()
-	for {
-		conn, err := ln.Accept()
+	st, err := newSettings(cfg, nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if cfg.HAR.Path != "" {
+		if st.har, err = NewHARRecorder(cfg.HAR); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if cfg.Fixtures.Mode != "" {
+		if st.fixtures, err = NewFixtureStore(cfg.Fixtures); err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("fixtures: %s %s\n", cfg.Fixtures.Mode, cfg.Fixtures.Dir)
+	}
+	applySettings(st)
+	go reloadOnHangup(*configPath)
+
+	upstreamPool = NewConnPool(cfg.Pool.MaxIdlePerHost,
+		time.Duration(cfg.Pool.IdleTimeout), 0)
+	// Dials follow reloaded timeouts
+	upstreamPool.dial = func(addr string) (net.Conn, error) {
+		return net.DialTimeout("tcp", addr, loadSettings().timeouts.Dial)
+	}
+
+	if cfg.Cache.Size > 0 {
+		var store cacheStore = newMemoryStore(cfg.Cache.Size)
+		if cfg.Cache.Dir != "" {
+			ds, err := newDiskStore(cfg.Cache.Dir, cfg.Cache.Size)
+			if err != nil {
+				log.Fatal(err)
+			}
+			log.Printf("cache: %v\n", ds)
+			store = ds
+		}
+		responseCache = NewCache(store, cfg.Cache.MaxObject)
+	}
+
+	if cfg.AdminListen != "" {
+		ln, err := net.Listen("tcp", cfg.AdminListen)
 		if err != nil {
-			log.Println(err)
-			continue
+			log.Fatal(err)
 		}
-		go handle(conn)
+		go ServeAdmin(ln)
 	}
-}
 
-func main() {
-	Serve()
+	go logPoolStats()
+	srv := &Server{Addr: cfg.Listen}
+	stopped := make(chan struct{})
+	go func() {
+		ch := make(chan os.Signal, 1)
+		signal.Notify(ch, syscall.SIGTERM, syscall.SIGINT)
+		sig := <-ch
+		log.Printf("shutting down on %v\n", sig)
+		ctx, cancel := context.WithTimeout(
+			context.Background(), time.Duration(cfg.ShutdownTimeout))
+		defer cancel()
+		if err := srv.Shutdown(ctx); err != nil {
+			log.Printf("connections closed before finishing: %v\n", err)
+		}
+		if har := loadSettings().har; har != nil {
+			if err := har.Close(); err != nil {
+				log.Println(err)
+			}
+		}
+		close(stopped)
+	}()
+	if err := srv.ListenAndServe(); err != ErrServerClosed {
+		log.Fatal(err)
+	}
+	<-stopped
 }
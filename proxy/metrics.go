@@ -0,0 +1,263 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Upper bounds of latency buckets in seconds
+var latencyBuckets = []float64{
+	0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10,
+}
+
+type histogram struct {
+	bounds []float64
+	// Observations in each bucket, not cumulative
+	counts []int64
+	sum    float64
+	count  int64
+}
+
+func newHistogram(bounds []float64) *histogram {
+	return &histogram{bounds: bounds, counts: make([]int64, len(bounds))}
+}
+
+func (h *histogram) observe(d time.Duration) {
+	v := d.Seconds()
+	if i := sort.SearchFloat64s(h.bounds, v); i < len(h.bounds) {
+		h.counts[i]++
+	}
+	h.sum += v
+	h.count++
+}
+
+// write writes the histogram in the Prometheus text format.
+func (h *histogram) write(w io.Writer, name string) {
+	var n int64
+	for i, bound := range h.bounds {
+		n += h.counts[i]
+		fmt.Fprintf(w, "%s_bucket{le=\"%s\"} %d\n",
+			name, strconv.FormatFloat(bound, 'g', -1, 64), n)
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, h.count)
+	fmt.Fprintf(w, "%s_sum %s\n", name, strconv.FormatFloat(h.sum, 'g', -1, 64))
+	fmt.Fprintf(w, "%s_count %d\n", name, h.count)
+}
+
+type requestKey struct {
+	method string
+	status int
+}
+
+// Metrics counts what the proxy has done since it started.
+type Metrics struct {
+	mu       sync.Mutex
+	requests map[requestKey]int64
+	// Bytes of bodies received from and sent to clients
+	bytesIn  int64
+	bytesOut int64
+	// Failures to connect to servers and parent proxies
+	dialErrors  int64
+	connsActive int64
+	connsTotal  int64
+	// From receiving a request header to the end of the response
+	requestDuration *histogram
+	// From sending a request to a server to receiving its response header
+	upstreamLatency *histogram
+}
+
+var metrics = NewMetrics()
+
+func NewMetrics() *Metrics {
+	return &Metrics{
+		requests:        make(map[requestKey]int64),
+		requestDuration: newHistogram(latencyBuckets),
+		upstreamLatency: newHistogram(latencyBuckets),
+	}
+}
+
+// Methods other than these are counted as "OTHER", so that clients can't
+// add labels without limit.
+var knownMethods = map[string]bool{
+	"GET": true, "HEAD": true, "POST": true, "PUT": true, "DELETE": true,
+	"CONNECT": true, "OPTIONS": true, "TRACE": true, "PATCH": true,
+}
+
+// addRequest counts a finished request. Status is 0 if no response was
+// sent.
+func (m *Metrics) addRequest(e *accessLogEntry, bytesIn int64) {
+	method := e.Method
+	if !knownMethods[method] {
+		method = "OTHER"
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.requests[requestKey{method, e.Status}]++
+	m.bytesIn += bytesIn
+	m.bytesOut += e.Bytes
+	m.requestDuration.observe(e.Duration)
+}
+
+func (m *Metrics) observeUpstreamLatency(d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.upstreamLatency.observe(d)
+}
+
+func (m *Metrics) addDialError() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.dialErrors++
+}
+
+// connOpened and connClosed track client connections.
+func (m *Metrics) connOpened() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.connsActive++
+	m.connsTotal++
+}
+
+func (m *Metrics) connClosed() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.connsActive--
+}
+
+// Write writes the metrics and pool stats in the Prometheus text format.
+func (m *Metrics) Write(w io.Writer, pool PoolStats) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	metric := func(name, typ, help string) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+	}
+
+	metric("proxy_requests_total", "counter",
+		"Requests by method and response status, 0 if no response was sent.")
+	keys := make([]requestKey, 0, len(m.requests))
+	for k := range m.requests {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].method != keys[j].method {
+			return keys[i].method < keys[j].method
+		}
+		return keys[i].status < keys[j].status
+	})
+	for _, k := range keys {
+		fmt.Fprintf(w, "proxy_requests_total{method=\"%s\",status=\"%d\"} %d\n",
+			k.method, k.status, m.requests[k])
+	}
+
+	metric("proxy_request_bytes_total", "counter",
+		"Bytes of request bodies received from clients.")
+	fmt.Fprintf(w, "proxy_request_bytes_total %d\n", m.bytesIn)
+	metric("proxy_response_bytes_total", "counter",
+		"Bytes of response bodies sent to clients.")
+	fmt.Fprintf(w, "proxy_response_bytes_total %d\n", m.bytesOut)
+	metric("proxy_upstream_dial_errors_total", "counter",
+		"Failures to connect to servers and parent proxies.")
+	fmt.Fprintf(w, "proxy_upstream_dial_errors_total %d\n", m.dialErrors)
+	metric("proxy_connections_active", "gauge",
+		"Client connections open.")
+	fmt.Fprintf(w, "proxy_connections_active %d\n", m.connsActive)
+	metric("proxy_connections_total", "counter",
+		"Client connections accepted.")
+	fmt.Fprintf(w, "proxy_connections_total %d\n", m.connsTotal)
+
+	metric("proxy_request_duration_seconds", "histogram",
+		"Time from receiving a request header to the end of the response.")
+	m.requestDuration.write(w, "proxy_request_duration_seconds")
+	metric("proxy_upstream_latency_seconds", "histogram",
+		"Time from sending a request to a server to receiving the response header.")
+	m.upstreamLatency.write(w, "proxy_upstream_latency_seconds")
+
+	metric("proxy_upstream_pool_dials_total", "counter",
+		"Connections to servers newly dialed.")
+	fmt.Fprintf(w, "proxy_upstream_pool_dials_total %d\n", pool.Dials)
+	metric("proxy_upstream_pool_reuses_total", "counter",
+		"Idle connections to servers reused.")
+	fmt.Fprintf(w, "proxy_upstream_pool_reuses_total %d\n", pool.Reuses)
+	metric("proxy_upstream_pool_idle", "gauge",
+		"Idle connections to servers.")
+	fmt.Fprintf(w, "proxy_upstream_pool_idle %d\n", pool.Idle)
+}
+
+// ServeAdmin serves /metrics on ln until it's closed.
+func ServeAdmin(ln net.Listener) error {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go handleAdminConn(conn)
+	}
+}
+
+// handleAdminConn serves requests to the admin listener on conn. They're
+// neither logged nor counted in the metrics.
+func handleAdminConn(conn net.Conn) {
+	defer conn.Close()
+	cl := NewClientHandler(conn, conn)
+	timeouts := loadSettings().timeouts
+	cl.SetTimeouts(conn, timeouts)
+	for {
+		if timeouts.KeepAlive > 0 {
+			conn.SetReadDeadline(time.Now().Add(timeouts.KeepAlive))
+		}
+		if err := cl.WaitForRequest(); err != nil {
+			return
+		}
+		conn.SetReadDeadline(time.Time{})
+		t := &transaction{cl: cl, clChan: cl.Start()}
+		req, err := waitForRequestHeader(t.clChan)
+		if err != nil {
+			log.Println(err)
+			t.sendErrorResponse(ResponseBadRequest)
+			t.wait()
+			return
+		}
+		t.sendResponse(adminResponse(req))
+		t.wait()
+		if t.aborted || !cl.KeepAlive() {
+			return
+		}
+	}
+}
+
+func adminResponse(req *Request) (*Response, []byte) {
+	res := &Response{Version: "HTTP/1.1", Status: 200, Phrase: "OK"}
+	var body []byte
+	path := req.originForm()
+	if pos := strings.Index(path, "?"); pos != -1 {
+		path = path[:pos]
+	}
+	switch {
+	case path != "/metrics":
+		res.Status, res.Phrase = 404, "Not Found"
+		body = []byte("Not found\n")
+		res.Headers.Add("Content-Type", "text/plain; charset=utf-8")
+	case req.Method != "GET" && req.Method != "HEAD":
+		res.Status, res.Phrase = 405, "Method Not Allowed"
+		body = []byte("Method not allowed\n")
+		res.Headers.Add("Allow", "GET, HEAD")
+		res.Headers.Add("Content-Type", "text/plain; charset=utf-8")
+	default:
+		var b strings.Builder
+		metrics.Write(&b, upstreamPool.Stats())
+		body = []byte(b.String())
+		res.Headers.Add("Content-Type", "text/plain; version=0.0.4")
+	}
+	res.Headers.Add("Content-Length", strconv.Itoa(len(body)))
+	if req.Method == "HEAD" {
+		body = nil
+	}
+	return res, body
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetrics(t *testing.T) {
+	m := NewMetrics()
+	m.addRequest(&accessLogEntry{Method: "GET", Status: 200, Bytes: 10,
+		Duration: 20 * time.Millisecond}, 0)
+	m.addRequest(&accessLogEntry{Method: "GET", Status: 200, Bytes: 5,
+		Duration: 3 * time.Second}, 0)
+	m.addRequest(&accessLogEntry{Method: "BREW", Status: 400}, 7)
+	m.addDialError()
+	m.connOpened()
+	m.connOpened()
+	m.connClosed()
+	m.observeUpstreamLatency(time.Millisecond)
+
+	var b strings.Builder
+	m.Write(&b, PoolStats{Dials: 3, Reuses: 1})
+	lines := make(map[string]bool)
+	for _, line := range strings.Split(b.String(), "\n") {
+		lines[line] = true
+	}
+	for _, line := range []string{
+		"# TYPE proxy_requests_total counter",
+		`proxy_requests_total{method="GET",status="200"} 2`,
+		`proxy_requests_total{method="OTHER",status="400"} 1`,
+		"proxy_request_bytes_total 7",
+		"proxy_response_bytes_total 15",
+		"proxy_upstream_dial_errors_total 1",
+		"proxy_connections_active 1",
+		"proxy_connections_total 2",
+		"# TYPE proxy_request_duration_seconds histogram",
+		`proxy_request_duration_seconds_bucket{le="0.01"} 1`,
+		`proxy_request_duration_seconds_bucket{le="0.025"} 2`,
+		`proxy_request_duration_seconds_bucket{le="2.5"} 2`,
+		`proxy_request_duration_seconds_bucket{le="5"} 3`,
+		`proxy_request_duration_seconds_bucket{le="+Inf"} 3`,
+		"proxy_request_duration_seconds_sum 3.02",
+		"proxy_request_duration_seconds_count 3",
+		`proxy_upstream_latency_seconds_bucket{le="0.005"} 1`,
+		"proxy_upstream_pool_dials_total 3",
+	} {
+		if !lines[line] {
+			t.Errorf("No line %q in:\n%s", line, b.String())
+		}
+	}
+}
+
+func TestAdminListener(t *testing.T) {
+	conn, peer := net.Pipe()
+	go handleAdminConn(conn)
+	defer peer.Close()
+	r := bufio.NewReader(peer)
+
+	go io.WriteString(peer, "GET /metrics HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	status, body := readTestResponse(t, r)
+	ExpectEqual(t, "HTTP/1.1 200 OK", status)
+	if !strings.Contains(body, "# TYPE proxy_requests_total counter\n") {
+		t.Errorf("Unexpected body: %s", body)
+	}
+
+	go io.WriteString(peer, "GET /other HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	status, _ = readTestResponse(t, r)
+	ExpectEqual(t, "HTTP/1.1 404 Not Found", status)
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"sort"
+)
+
+// A Middleware inspects and modifies requests forwarded to servers, and
+// their responses. CONNECT tunnels don't pass through it.
+type Middleware interface {
+	// Request is called with the request about to be sent to the server,
+	// which may be modified. It returns the filter of the response, or nil
+	// to leave the response as it is.
+	Request(req *Request, clientAddr net.Addr) ResponseFilter
+}
+
+// A ResponseFilter modifies a response from the server or the cache
+// before it's sent to the client.
+type ResponseFilter interface {
+	// Header returns the header to send. Res may be shared with the cache,
+	// so it must be copied to be modified.
+	Header(res *Response) *Response
+	// Body returns what to send for a part of the body, where isEnd is
+	// true for the last one. If the length of the body changes, Header
+	// must have replaced Content-Length with chunked Transfer-Encoding.
+	Body(b []byte, isEnd bool) []byte
+}
+
+// MiddlewareConfig selects a registered middleware in the config, like
+// {"name": "headers", "config": {...}}.
+type MiddlewareConfig struct {
+	Name   string          `json:"name"`
+	Config json.RawMessage `json:"config"`
+}
+
+// A MiddlewareFactory makes a middleware from its config, which is empty
+// if not given.
+type MiddlewareFactory func(config json.RawMessage) (Middleware, error)
+
+var middlewareFactories = map[string]MiddlewareFactory{}
+
+// RegisterMiddleware makes a middleware available in the config by name.
+// It must be called from init.
+func RegisterMiddleware(name string, f MiddlewareFactory) {
+	if _, ok := middlewareFactories[name]; ok {
+		panic("Middleware registered twice: " + name)
+	}
+	middlewareFactories[name] = f
+}
+
+// A middlewareChain runs requests through middlewares in order, and the
+// responses in the reverse order.
+type middlewareChain []Middleware
+
+func newMiddlewareChain(configs []MiddlewareConfig) (middlewareChain, error) {
+	var chain middlewareChain
+	for i, c := range configs {
+		f, ok := middlewareFactories[c.Name]
+		if !ok {
+			var names []string
+			for name := range middlewareFactories {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			return nil, fmt.Errorf("Unknown middleware %q, not one of %v",
+				c.Name, names)
+		}
+		m, err := f(c.Config)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid middleware %d (%s): %w",
+				i, c.Name, err)
+		}
+		chain = append(chain, m)
+	}
+	return chain, nil
+}
+
+// request returns the filters of the response to req, in the order to
+// apply them.
+func (chain middlewareChain) request(
+	req *Request, clientAddr net.Addr) []ResponseFilter {
+	var filters []ResponseFilter
+	for _, m := range chain {
+		if f := m.Request(req, clientAddr); f != nil {
+			filters = append([]ResponseFilter{f}, filters...)
+		}
+	}
+	return filters
+}
+
+// decodeMiddlewareConfig decodes config into v, rejecting unknown fields.
+func decodeMiddlewareConfig(config json.RawMessage, v interface{}) error {
+	if len(config) == 0 {
+		return nil
+	}
+	dec := json.NewDecoder(bytes.NewReader(config))
+	dec.DisallowUnknownFields()
+	return dec.Decode(v)
+}
+
+// headerRules set and remove header fields.
+type headerRules struct {
+	Set    map[string]string `json:"set"`
+	Remove []string          `json:"remove"`
+}
+
+func (r *headerRules) apply(h *HTTPHeader) {
+	for _, name := range r.Remove {
+		h.Del(name)
+	}
+	// Sorted for a stable order of fields
+	names := make([]string, 0, len(r.Set))
+	for name := range r.Set {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		h.Set(name, r.Set[name])
+	}
+}
+
+// headersMiddleware modifies header fields of requests and responses, as
+// configured like:
+//
+//	{"request": {"set": {"X-Team": "web"}, "remove": ["Cookie"]},
+//	 "response": {"remove": ["Server"]}}
+type headersMiddleware struct {
+	Req headerRules `json:"request"`
+	Res headerRules `json:"response"`
+}
+
+func init() {
+	RegisterMiddleware("headers", func(config json.RawMessage) (Middleware, error) {
+		m := &headersMiddleware{}
+		if err := decodeMiddlewareConfig(config, m); err != nil {
+			return nil, err
+		}
+		return m, nil
+	})
+}
+
+func (m *headersMiddleware) Request(
+	req *Request, clientAddr net.Addr) ResponseFilter {
+	m.Req.apply(&req.Headers)
+	if len(m.Res.Set) == 0 && len(m.Res.Remove) == 0 {
+		return nil
+	}
+	return m
+}
+
+func (m *headersMiddleware) Header(res *Response) *Response {
+	out := *res
+	out.Headers = res.Headers.Clone()
+	m.Res.apply(&out.Headers)
+	return &out
+}
+
+func (m *headersMiddleware) Body(b []byte, isEnd bool) []byte {
+	return b
+}
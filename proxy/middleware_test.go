@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+// upperMiddleware tags requests, and upper-cases response bodies.
+type upperMiddleware struct {
+	tag string
+}
+
+func (m *upperMiddleware) Request(
+	req *Request, clientAddr net.Addr) ResponseFilter {
+	req.Headers.Add("X-Tag", m.tag)
+	return m
+}
+
+func (m *upperMiddleware) Header(res *Response) *Response {
+	out := *res
+	out.Headers = res.Headers.Clone()
+	out.Headers.Del("Content-Length")
+	out.Headers.Set("Transfer-Encoding", "chunked")
+	out.Headers.Add("X-Filtered", m.tag)
+	return &out
+}
+
+func (m *upperMiddleware) Body(b []byte, isEnd bool) []byte {
+	return bytes.ToUpper(b)
+}
+
+func TestMiddlewareChain(t *testing.T) {
+	headers, err := newMiddlewareChain([]MiddlewareConfig{{
+		Name: "headers",
+		Config: json.RawMessage(`{"request": {"remove": ["Cookie"]},
+			"response": {"set": {"Server": "proxy"}}}`),
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain := append(middlewareChain{&upperMiddleware{"1"}, &upperMiddleware{"2"}},
+		headers...)
+	withSettings(t, func(st *settings) { st.middleware = chain })
+
+	ln, accepted := listen(t)
+	defer ln.Close()
+	received := make(chan []string, 1)
+	go func() {
+		conn := <-accepted
+		defer conn.Close()
+		received <- readTestRequestHeader(bufio.NewReader(conn))
+		io.WriteString(conn, "HTTP/1.1 200 OK\r\nServer: origin\r\n"+
+			"Content-Length: 5\r\n\r\nhello")
+	}()
+
+	conn, peer := net.Pipe()
+	go handle(conn)
+	defer peer.Close()
+	go io.WriteString(peer, "GET http://"+ln.Addr().String()+"/ HTTP/1.1\r\n"+
+		"Cookie: a=b\r\n\r\n")
+	r := bufio.NewReader(peer)
+	lines := readTestRequestHeader(r)
+	ExpectEqual(t, "HTTP/1.1 200 OK", lines[0])
+	// Responses pass through the middlewares in reverse
+	var filtered []string
+	for _, line := range lines {
+		if v, ok := strings.CutPrefix(line, "X-Filtered: "); ok {
+			filtered = append(filtered, v)
+		}
+		if v, ok := strings.CutPrefix(line, "Server: "); ok {
+			ExpectEqual(t, "proxy", v)
+		}
+	}
+	ExpectEqual(t, "2,1", strings.Join(filtered, ","))
+	body, _ := r.ReadString('\n')
+	ExpectEqual(t, "5", strings.TrimSpace(body))
+	body, _ = r.ReadString('\n')
+	ExpectEqual(t, "HELLO", strings.TrimSpace(body))
+
+	var tags []string
+	for _, line := range <-received {
+		if strings.HasPrefix(line, "Cookie:") {
+			t.Errorf("Cookie wasn't removed")
+		}
+		if v, ok := strings.CutPrefix(line, "X-Tag: "); ok {
+			tags = append(tags, v)
+		}
+	}
+	ExpectEqual(t, "1,2", strings.Join(tags, ","))
+}
+
+func TestMiddlewareConfig(t *testing.T) {
+	for _, c := range []MiddlewareConfig{
+		{Name: "unknown"},
+		{Name: "headers", Config: json.RawMessage(`{"requests": {}}`)},
+	} {
+		if _, err := newMiddlewareChain([]MiddlewareConfig{c}); err == nil {
+			t.Errorf("Invalid middleware was accepted: %s", c.Name)
+		}
+	}
+}
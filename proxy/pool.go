@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// An upstreamConn is a connection to a server. Its reader is kept with it
+// so that nothing buffered is lost when it's reused.
+type upstreamConn struct {
+	net.Conn
+	addr      string
+	r         *bufio.Reader
+	idleSince time.Time
+	// Receives the result of reading while idle
+	peeked chan error
+}
+
+type PoolStats struct {
+	Dials   int // Connections newly dialed
+	Reuses  int // Idle connections reused
+	Expired int // Idle connections closed for idleTimeout
+	Stale   int // Idle connections found closed by the server
+	Idle    int // Connections currently idle
+	Hosts   int // Hosts with idle connections
+}
+
+func (s PoolStats) String() string {
+	return fmt.Sprintf(
+		"dials=%d reuses=%d expired=%d stale=%d idle=%d hosts=%d",
+		s.Dials, s.Reuses, s.Expired, s.Stale, s.Idle, s.Hosts)
+}
+
+// ConnPool keeps idle connections to servers keyed by "host:port".
+type ConnPool struct {
+	maxIdlePerHost int
+	idleTimeout    time.Duration
+	dial           func(addr string) (net.Conn, error)
+
+	mu    sync.Mutex
+	idle  map[string][]*upstreamConn
+	stats PoolStats
+}
+
+// Dials time out after dialTimeout unless it's zero.
+func NewConnPool(
+	maxIdlePerHost int, idleTimeout, dialTimeout time.Duration) *ConnPool {
+	return &ConnPool{
+		maxIdlePerHost: maxIdlePerHost,
+		idleTimeout:    idleTimeout,
+		dial: func(addr string) (net.Conn, error) {
+			return net.DialTimeout("tcp", addr, dialTimeout)
+		},
+		idle: make(map[string][]*upstreamConn),
+	}
+}
+
+// watch waits on an idle connection for the server to close it, and removes
+// it from the pool if so. Any data sent by the server while idle makes the
+// connection unusable too.
+func (p *ConnPool) watch(c *upstreamConn) {
+	_, err := c.r.Peek(1)
+	p.mu.Lock()
+	if p.remove(c) {
+		c.Close()
+		p.stats.Stale++
+	}
+	p.mu.Unlock()
+	c.peeked <- err
+}
+
+// wake stops watching c taken from the pool, and reports whether it's still
+// usable.
+func (c *upstreamConn) wake() bool {
+	c.SetReadDeadline(time.Now())
+	err := <-c.peeked
+	c.SetReadDeadline(time.Time{})
+	nerr, ok := err.(net.Error)
+	return ok && nerr.Timeout()
+}
+
+// remove must be called with p.mu held.
+func (p *ConnPool) remove(c *upstreamConn) bool {
+	conns := p.idle[c.addr]
+	for i, ic := range conns {
+		if ic != c {
+			continue
+		}
+		conns = append(conns[:i:i], conns[i+1:]...)
+		if len(conns) == 0 {
+			delete(p.idle, c.addr)
+		} else {
+			p.idle[c.addr] = conns
+		}
+		return true
+	}
+	return false
+}
+
+// removeExpired must be called with p.mu held.
+func (p *ConnPool) removeExpired(now time.Time) {
+	for addr, conns := range p.idle {
+		// conns are ordered from the oldest
+		n := 0
+		for n < len(conns) && now.Sub(conns[n].idleSince) >= p.idleTimeout {
+			conns[n].Close()
+			n++
+		}
+		p.stats.Expired += n
+		if n == len(conns) {
+			delete(p.idle, addr)
+		} else {
+			p.idle[addr] = conns[n:]
+		}
+	}
+}
+
+// takeIdle returns the most recently used idle connection to addr, or nil.
+func (p *ConnPool) takeIdle(addr string) *upstreamConn {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.removeExpired(time.Now())
+	conns := p.idle[addr]
+	if len(conns) == 0 {
+		return nil
+	}
+	c := conns[len(conns)-1]
+	if len(conns) == 1 {
+		delete(p.idle, addr)
+	} else {
+		p.idle[addr] = conns[:len(conns)-1]
+	}
+	return c
+}
+
+func (p *ConnPool) addStat(stat *int) {
+	p.mu.Lock()
+	*stat++
+	p.mu.Unlock()
+}
+
+// Get returns an idle connection to addr if there's a live one, or dials.
+func (p *ConnPool) Get(addr string) (*upstreamConn, error) {
+	for {
+		c := p.takeIdle(addr)
+		if c == nil {
+			break
+		}
+		if !c.wake() {
+			c.Close()
+			p.addStat(&p.stats.Stale)
+			continue
+		}
+		p.addStat(&p.stats.Reuses)
+		return c, nil
+	}
+	conn, err := p.dial(addr)
+	if err != nil {
+		return nil, err
+	}
+	p.addStat(&p.stats.Dials)
+	return &upstreamConn{Conn: conn, addr: addr, r: bufio.NewReader(conn)}, nil
+}
+
+// Put returns c to the pool. It's closed if the pool is full for its host.
+func (p *ConnPool) Put(c *upstreamConn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	p.removeExpired(now)
+	conns := p.idle[c.addr]
+	if len(conns) >= p.maxIdlePerHost {
+		c.Close()
+		return
+	}
+	// Deadlines of the last request
+	c.SetDeadline(time.Time{})
+	c.idleSince = now
+	p.idle[c.addr] = append(conns, c)
+	if c.peeked == nil {
+		c.peeked = make(chan error, 1)
+	}
+	go p.watch(c)
+}
+
+func (p *ConnPool) Stats() PoolStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	s := p.stats
+	for _, conns := range p.idle {
+		s.Idle += len(conns)
+	}
+	s.Hosts = len(p.idle)
+	return s
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// listen accepts connections and sends them to the returned channel.
+func listen(t *testing.T) (net.Listener, chan net.Conn) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ch := make(chan net.Conn, 10)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			ch <- conn
+		}
+	}()
+	return ln, ch
+}
+
+func TestConnPool(t *testing.T) {
+	ln, accepted := listen(t)
+	defer ln.Close()
+	addr := ln.Addr().String()
+	p := NewConnPool(1, time.Minute, 0)
+
+	c1, err := p.Get(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Put(c1)
+	c2, err := p.Get(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c1 != c2 {
+		t.Errorf("Idle connection wasn't reused")
+	}
+
+	// The server closes the idle connection
+	p.Put(c2)
+	(<-accepted).Close()
+	time.Sleep(10 * time.Millisecond)
+	c3, err := p.Get(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c3 == c2 {
+		t.Errorf("Closed connection was reused")
+	}
+	defer c3.Close()
+
+	s := p.Stats()
+	if s.Dials != 2 || s.Reuses != 1 || s.Stale != 1 || s.Idle != 0 {
+		t.Errorf("Unexpected stats: %v", s)
+	}
+}
+
+func TestConnPoolExpire(t *testing.T) {
+	ln, _ := listen(t)
+	defer ln.Close()
+	addr := ln.Addr().String()
+	p := NewConnPool(1, time.Millisecond, 0)
+
+	c1, err := p.Get(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Put(c1)
+	time.Sleep(10 * time.Millisecond)
+	c2, err := p.Get(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c2.Close()
+	if c1 == c2 {
+		t.Errorf("Expired connection was reused")
+	}
+	if s := p.Stats(); s.Expired != 1 {
+		t.Errorf("Unexpected stats: %v", s)
+	}
+}
+
+func TestProxyReusesConn(t *testing.T) {
+	ln, accepted := listen(t)
+	defer ln.Close()
+	conns := make(chan struct{}, 10)
+	go func() {
+		for conn := range accepted {
+			conns <- struct{}{}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				for len(readTestRequestHeader(r)) > 0 {
+					io.WriteString(conn,
+						"HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok")
+				}
+			}(conn)
+		}
+	}()
+
+	conn, peer := net.Pipe()
+	go handle(conn)
+	defer peer.Close()
+	r := bufio.NewReader(peer)
+	addr := ln.Addr().String()
+	// Each response has been read when the next request is served
+	for i := 0; i < 3; i++ {
+		go io.WriteString(peer, "GET http://"+addr+"/ HTTP/1.1\r\n\r\n")
+		status, _ := readTestResponse(t, r)
+		ExpectEqual(t, "HTTP/1.1 200 OK", status)
+	}
+	ExpectEqual(t, "1", strconv.Itoa(len(conns)))
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RouteConfig maps requests to a virtual host and path prefix to backends,
+// like:
+//
+//	{"host": "api.example.com", "path": "/v1",
+//	 "backends": ["10.0.0.1:8080", "10.0.0.2:8080"], "balance": "least_conn",
+//	 "health_check": {"path": "/healthz", "interval": "5s"},
+//	 "strip_prefix": true, "host_header": "api.internal"}
+type RouteConfig struct {
+	// Host without the port, a glob like "*.example.com", or "" for any
+	Host string `json:"host"`
+	// Matches the path itself and those under it, "/" if empty
+	Path string `json:"path"`
+	// A single backend can be given as Backend
+	Backend  string   `json:"backend"`
+	Backends []string `json:"backends"`
+	// BalanceRoundRobin if empty
+	Balance string `json:"balance"`
+	// Key of BalanceHash: "client_ip" if empty, "uri" or "header:<name>"
+	HashKey string `json:"hash_key"`
+	// nil not to check actively
+	HealthCheck *HealthCheckConfig `json:"health_check"`
+	// A backend is ejected for FailTimeout after MaxFails consecutive
+	// failures to connect or to get a response, 3 and 30s if zero
+	MaxFails    int      `json:"max_fails"`
+	FailTimeout Duration `json:"fail_timeout"`
+	// Whether Path is removed from the path sent to the backend
+	StripPrefix bool `json:"strip_prefix"`
+	// Host sent to the backend, or "" to keep the client's
+	HostHeader string `json:"host_header"`
+}
+
+type route struct {
+	RouteConfig
+	// 0 for an exact host, 1 for a glob and 2 for any
+	hostRank int
+	lb       *balancer
+}
+
+// Routes are the routing table of the reverse proxy. Requests in absolute
+// form are routed by their authority, and those in origin form by Host.
+// Requests without a route, including CONNECT, are refused unless
+// Config.ForwardProxy is set, with which those in absolute form are
+// forwarded as by a proxy.
+type Routes struct {
+	// Most specific first
+	routes []*route
+	// Closed to stop health checks
+	quit chan struct{}
+}
+
+func NewRoutes(configs []RouteConfig) (*Routes, error) {
+	if len(configs) == 0 {
+		return nil, nil
+	}
+	rs := &Routes{}
+	for i, c := range configs {
+		r := &route{RouteConfig: c}
+		r.Host = strings.ToLower(r.Host)
+		switch {
+		case r.Host == "":
+			r.hostRank = 2
+		case strings.ContainsAny(r.Host, "*?["):
+			if _, err := path.Match(r.Host, ""); err != nil {
+				return nil, fmt.Errorf("routes[%d].host: invalid pattern %q",
+					i, c.Host)
+			}
+			r.hostRank = 1
+		}
+		if r.Path == "" {
+			r.Path = "/"
+		}
+		if !strings.HasPrefix(r.Path, "/") {
+			return nil, fmt.Errorf("routes[%d].path: must start with /", i)
+		}
+		if err := r.setDefaults(); err != nil {
+			return nil, fmt.Errorf("routes[%d].%w", i, err)
+		}
+		rs.routes = append(rs.routes, r)
+	}
+	// Exact hosts before globs before any, then longer paths first
+	sort.SliceStable(rs.routes, func(i, j int) bool {
+		a, b := rs.routes[i], rs.routes[j]
+		if a.hostRank != b.hostRank {
+			return a.hostRank < b.hostRank
+		}
+		return len(a.Path) > len(b.Path)
+	})
+	return rs, nil
+}
+
+// setDefaults validates the balancing of r, and fills the defaults.
+func (r *route) setDefaults() error {
+	addrs := r.Backends
+	if r.Backend != "" {
+		addrs = append([]string{r.Backend}, addrs...)
+	}
+	if len(addrs) == 0 {
+		return fmt.Errorf("backends: none given")
+	}
+	for _, addr := range addrs {
+		if _, port, err := net.SplitHostPort(addr); err != nil {
+			return fmt.Errorf("backends: %w", err)
+		} else if _, err := strconv.Atoi(port); err != nil {
+			return fmt.Errorf("backends: invalid port %q", port)
+		}
+	}
+	switch r.Balance {
+	case "":
+		r.Balance = BalanceRoundRobin
+	case BalanceRoundRobin, BalanceLeastConn, BalanceHash:
+	default:
+		return fmt.Errorf("balance: unknown policy %q", r.Balance)
+	}
+	switch {
+	case r.HashKey == "":
+		r.HashKey = "client_ip"
+	case r.HashKey == "client_ip", r.HashKey == "uri",
+		strings.HasPrefix(r.HashKey, "header:"):
+	default:
+		return fmt.Errorf("hash_key: unknown key %q", r.HashKey)
+	}
+	if r.MaxFails < 0 || r.FailTimeout < 0 {
+		return fmt.Errorf("max_fails: must not be negative")
+	}
+	if r.MaxFails == 0 {
+		r.MaxFails = 3
+	}
+	if r.FailTimeout == 0 {
+		r.FailTimeout = Duration(30 * time.Second)
+	}
+	if hc := r.HealthCheck; hc != nil {
+		c := *hc
+		if c.Path == "" {
+			c.Path = "/"
+		}
+		if !strings.HasPrefix(c.Path, "/") {
+			return fmt.Errorf("health_check.path: must start with /")
+		}
+		if c.Interval == 0 {
+			c.Interval = Duration(10 * time.Second)
+		}
+		if c.Timeout == 0 {
+			c.Timeout = Duration(2 * time.Second)
+		}
+		if c.Interval < 0 || c.Timeout < 0 {
+			return fmt.Errorf("health_check: must not be negative")
+		}
+		r.HealthCheck = &c
+	}
+	r.lb = newBalancer(r.Balance, addrs)
+	return nil
+}
+
+func (r *route) matchesHost(host string) bool {
+	switch r.hostRank {
+	case 0:
+		return host == r.Host
+	case 1:
+		ok, _ := path.Match(r.Host, host)
+		return ok
+	}
+	return true
+}
+
+// matchesPath reports whether p is the path of r or under it, so that
+// "/api" matches "/api" and "/api/users" but not "/apis".
+func (r *route) matchesPath(p string) bool {
+	if !strings.HasPrefix(p, r.Path) {
+		return false
+	}
+	return len(p) == len(r.Path) || strings.HasSuffix(r.Path, "/") ||
+		p[len(r.Path)] == '/'
+}
+
+// match returns the route of req, or nil if there's none.
+func (rs *Routes) match(req *Request) *route {
+	if rs == nil {
+		return nil
+	}
+	host := req.TargetHost()
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	p, _, _ := strings.Cut(req.originForm(), "?")
+	for _, r := range rs.routes {
+		if r.matchesHost(host) && r.matchesPath(p) {
+			return r
+		}
+	}
+	return nil
+}
+
+// rewrite modifies out, the request forwarded to the backend.
+func (r *route) rewrite(out *Request) {
+	if r.StripPrefix && r.Path != "/" {
+		p, query, hasQuery := strings.Cut(out.URI, "?")
+		p = "/" + strings.TrimPrefix(strings.TrimPrefix(p, r.Path), "/")
+		if hasQuery {
+			p += "?" + query
+		}
+		out.URI = p
+	}
+	if r.HostHeader != "" {
+		if host := out.Headers.Get("host"); host != "" {
+			out.Headers.Set("X-Forwarded-Host", host)
+		}
+		out.Headers.Set("Host", r.HostHeader)
+	}
+}
+
+// noRouteResponse returns 404 for a request without a route.
+func noRouteResponse() (*Response, []byte) {
+	body := []byte("No route\n")
+	res := &Response{
+		Version: "HTTP/1.1",
+		Status:  404,
+		Phrase:  "Not Found",
+	}
+	res.Headers.Add("Content-Type", "text/plain; charset=utf-8")
+	res.Headers.Add("Content-Length", strconv.Itoa(len(body)))
+	return res, body
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestRoutes(t *testing.T) {
+	rs, err := NewRoutes([]RouteConfig{
+		{Backend: "default:80"},
+		{Host: "*.example.com", Backend: "wildcard:80"},
+		{Host: "api.example.com", Backend: "api:80"},
+		{Host: "api.example.com", Path: "/v2", Backend: "v2:80",
+			StripPrefix: true, HostHeader: "v2.internal"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend := func(host, uri string) string {
+		r := rs.match(&Request{Method: "GET", URI: uri,
+			Headers: HTTPHeader{{"Host", host}}})
+		if r == nil {
+			return ""
+		}
+		return r.Backend
+	}
+	ExpectEqual(t, "v2:80", backend("API.example.com:8080", "/v2/users?q=1"))
+	ExpectEqual(t, "v2:80", backend("api.example.com", "/v2"))
+	ExpectEqual(t, "api:80", backend("api.example.com", "/v2s"))
+	ExpectEqual(t, "wildcard:80", backend("www.example.com", "/v2"))
+	ExpectEqual(t, "default:80", backend("example.org", "/"))
+	// Requests in absolute form are routed by the authority
+	r := rs.match(&Request{Method: "GET", URI: "http://api.example.com/v2/x",
+		Authority: "api.example.com", Headers: HTTPHeader{{"Host", "other"}}})
+	if r == nil {
+		t.Fatalf("Request in absolute form wasn't routed")
+	}
+	ExpectEqual(t, "v2:80", r.Backend)
+
+	for _, c := range []struct{ uri, rewritten string }{
+		{"/v2/users?q=1", "/users?q=1"},
+		{"/v2", "/"},
+		{"/v2?q=1", "/?q=1"},
+	} {
+		out := &Request{URI: c.uri, Headers: HTTPHeader{{"Host", "api.example.com"}}}
+		rs.match(out).rewrite(out)
+		ExpectEqual(t, c.rewritten, out.URI)
+		ExpectEqual(t, "v2.internal", out.Headers.Get("host"))
+		ExpectEqual(t, "api.example.com", out.Headers.Get("x-forwarded-host"))
+	}
+
+	for _, c := range []RouteConfig{
+		{Backend: "nohost"},
+		{Path: "api", Backend: "api:80"},
+		{Host: "[", Backend: "api:80"},
+	} {
+		if _, err := NewRoutes([]RouteConfig{c}); err == nil {
+			t.Errorf("Invalid route was accepted: %v", c)
+		}
+	}
+}
+
+func TestReverseProxy(t *testing.T) {
+	ln, accepted := listen(t)
+	defer ln.Close()
+	rs, err := NewRoutes([]RouteConfig{{Host: "www.example.com", Path: "/app/",
+		Backend: ln.Addr().String(), StripPrefix: true}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	withSettings(t, func(st *settings) { st.routes = rs })
+
+	received := make(chan []string, 1)
+	go func() {
+		for conn := range accepted {
+			go func(conn net.Conn) {
+				defer conn.Close()
+				received <- readTestRequestHeader(bufio.NewReader(conn))
+				io.WriteString(conn,
+					"HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok")
+			}(conn)
+		}
+	}()
+
+	conn, peer := net.Pipe()
+	go handle(conn)
+	defer peer.Close()
+	r := bufio.NewReader(peer)
+	go io.WriteString(peer,
+		"GET /app/index.html HTTP/1.1\r\nHost: www.example.com\r\n\r\n")
+	status, body := readTestResponse(t, r)
+	ExpectEqual(t, "HTTP/1.1 200 OK", status)
+	ExpectEqual(t, "ok", body)
+	lines := <-received
+	ExpectEqual(t, "GET /index.html HTTP/1.1", lines[0])
+	ExpectEqual(t, "Host: www.example.com", strings.Join(lines[1:2], ""))
+
+	go io.WriteString(peer, "GET /other HTTP/1.1\r\nHost: www.example.com\r\n\r\n")
+	status, _ = readTestResponse(t, r)
+	ExpectEqual(t, "HTTP/1.1 404 Not Found", status)
+
+	// It isn't an open proxy
+	addr := ln.Addr().String()
+	forward := "GET http://" + addr + "/ HTTP/1.1\r\nHost: " + addr + "\r\n\r\n"
+	go io.WriteString(peer, forward)
+	status, _ = readTestResponse(t, r)
+	ExpectEqual(t, "HTTP/1.1 404 Not Found", status)
+	go io.WriteString(peer, "CONNECT "+addr+" HTTP/1.1\r\nHost: "+addr+"\r\n\r\n")
+	status, _ = readTestResponse(t, r)
+	ExpectEqual(t, "HTTP/1.1 404 Not Found", status)
+
+	// Unless it's also a forward proxy
+	withSettings(t, func(st *settings) { st.forwardProxy = true })
+	conn, peer = net.Pipe()
+	go handle(conn)
+	defer peer.Close()
+	r = bufio.NewReader(peer)
+	go io.WriteString(peer, forward)
+	status, body = readTestResponse(t, r)
+	ExpectEqual(t, "HTTP/1.1 200 OK", status)
+	ExpectEqual(t, "ok", body)
+	lines = <-received
+	ExpectEqual(t, "GET / HTTP/1.1", lines[0])
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// ErrServerClosed is returned by ListenAndServe and Serve after Shutdown.
+var ErrServerClosed = errors.New("Server closed")
+
+// A Server accepts clients and serves their requests until Shutdown.
+type Server struct {
+	// ":8080" if empty
+	Addr string
+
+	mu      sync.Mutex
+	ln      net.Listener
+	closing bool
+	// Connections being served, true if waiting for a request
+	conns map[net.Conn]bool
+}
+
+func (s *Server) ListenAndServe() error {
+	addr := s.Addr
+	if addr == "" {
+		addr = ":8080"
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(ln)
+}
+
+// Serve accepts connections on ln and closes it when returning.
+func (s *Server) Serve(ln net.Listener) error {
+	defer ln.Close()
+	s.mu.Lock()
+	if s.closing {
+		s.mu.Unlock()
+		return ErrServerClosed
+	}
+	s.ln = ln
+	if s.conns == nil {
+		s.conns = make(map[net.Conn]bool)
+	}
+	s.mu.Unlock()
+
+	var backoff time.Duration
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if s.isClosing() {
+				return ErrServerClosed
+			}
+			// Out of file descriptors for example, which may be temporary
+			if backoff == 0 {
+				backoff = 5 * time.Millisecond
+			} else if backoff < time.Second {
+				backoff *= 2
+			}
+			log.Println(err)
+			time.Sleep(backoff)
+			continue
+		}
+		backoff = 0
+
+		ip := clientIP(conn.RemoteAddr())
+		if !limiter.acquireConn(ip) {
+			log.Printf("too many connections: %s\n", conn.RemoteAddr().String())
+			rejectConn(conn)
+			continue
+		}
+		if !s.track(conn) {
+			limiter.releaseConn(ip)
+			conn.Close()
+			continue
+		}
+		go func() {
+			defer limiter.releaseConn(ip)
+			defer s.untrack(conn)
+			handleConn(conn, s)
+		}()
+	}
+}
+
+func (s *Server) isClosing() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closing
+}
+
+// track adds conn unless shutting down.
+func (s *Server) track(conn net.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closing {
+		return false
+	}
+	s.conns[conn] = false
+	return true
+}
+
+func (s *Server) untrack(conn net.Conn) {
+	s.mu.Lock()
+	delete(s.conns, conn)
+	s.mu.Unlock()
+}
+
+// setIdle records whether conn is waiting for a request, and reports
+// whether it should be served further.
+func (s *Server) setIdle(conn net.Conn, idle bool) bool {
+	if s == nil {
+		return true
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closing && idle {
+		return false
+	}
+	s.conns[conn] = idle
+	return true
+}
+
+// Shutdown stops accepting connections, closes idle ones, and waits for
+// the others to finish their current requests. Once ctx is done, the
+// remaining connections are closed and its error is returned.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.closing = true
+	if s.ln != nil {
+		s.ln.Close()
+	}
+	for conn, idle := range s.conns {
+		if idle {
+			conn.Close()
+		}
+	}
+	s.mu.Unlock()
+
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		s.mu.Lock()
+		n := len(s.conns)
+		s.mu.Unlock()
+		if n == 0 {
+			return nil
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			s.mu.Lock()
+			for conn := range s.conns {
+				conn.Close()
+			}
+			s.mu.Unlock()
+			return ctx.Err()
+		}
+	}
+}
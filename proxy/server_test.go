@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+type testServer struct {
+	s *Server
+	// Result of Serve
+	served chan error
+	addr   string
+	// The origin receives requests to received, and answers them after
+	// release is closed
+	origin   string
+	received chan struct{}
+	release  chan struct{}
+}
+
+// startTestServer serves on a local port, with a slow origin.
+func startTestServer(t *testing.T) *testServer {
+	origin, accepted := listen(t)
+	t.Cleanup(func() { origin.Close() })
+	received := make(chan struct{}, 1)
+	release := make(chan struct{})
+	go func() {
+		for conn := range accepted {
+			go func(conn net.Conn) {
+				defer conn.Close()
+				readTestRequestHeader(bufio.NewReader(conn))
+				received <- struct{}{}
+				<-release
+				io.WriteString(conn,
+					"HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok")
+			}(conn)
+		}
+	}()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{}
+	served := make(chan error, 1)
+	go func() { served <- s.Serve(ln) }()
+	return &testServer{s, served, ln.Addr().String(), origin.Addr().String(),
+		received, release}
+}
+
+// request sends a request to the origin through a new connection.
+func (ts *testServer) request(t *testing.T) net.Conn {
+	conn, err := net.Dial("tcp", ts.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(conn, "GET http://"+ts.origin+"/ HTTP/1.1\r\n\r\n")
+	<-ts.received
+	return conn
+}
+
+// waitForConns waits until s is serving n connections.
+func waitForConns(t *testing.T, s *Server, n int) {
+	for i := 0; i < 100; i++ {
+		s.mu.Lock()
+		m := len(s.conns)
+		s.mu.Unlock()
+		if m == n {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("Connections weren't %d", n)
+}
+
+func TestServerShutdown(t *testing.T) {
+	ts := startTestServer(t)
+	s := ts.s
+	busy := ts.request(t)
+	defer busy.Close()
+	idle, err := net.Dial("tcp", ts.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idle.Close()
+	waitForConns(t, s, 2)
+
+	shutdown := make(chan error, 1)
+	go func() { shutdown <- s.Shutdown(context.Background()) }()
+
+	// Idle connections are closed, and new ones aren't accepted
+	if _, err := idle.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("Idle connection wasn't closed: %v", err)
+	}
+	ExpectEqual(t, ErrServerClosed.Error(), (<-ts.served).Error())
+	if c, err := net.Dial("tcp", ts.addr); err == nil {
+		c.Close()
+		t.Errorf("Connection was accepted after Shutdown")
+	}
+
+	// The request in flight finishes
+	close(ts.release)
+	status, body := readTestResponse(t, bufio.NewReader(busy))
+	ExpectEqual(t, "HTTP/1.1 200 OK", status)
+	ExpectEqual(t, "ok", body)
+	if err := <-shutdown; err != nil {
+		t.Errorf("Shutdown failed: %v", err)
+	}
+}
+
+func TestServerShutdownTimeout(t *testing.T) {
+	ts := startTestServer(t)
+	defer close(ts.release)
+	busy := ts.request(t)
+	defer busy.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(),
+		50*time.Millisecond)
+	defer cancel()
+	if err := ts.s.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if _, err := busy.Read(make([]byte, 1)); err == nil {
+		t.Errorf("Connection wasn't closed")
+	}
+}
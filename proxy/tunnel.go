@@ -0,0 +1,109 @@
+package main
+
+import (
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+var ResponseConnectionEstablished = &Response{
+	Version: "HTTP/1.1",
+	Status:  200,
+	Phrase:  "Connection established",
+}
+
+// closeWrite tells the peer that nothing more is sent on c.
+func closeWrite(c net.Conn) {
+	if cw, ok := c.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+	} else {
+		c.Close()
+	}
+}
+
+// relay copies bytes between the client and the server in both directions
+// until both sides have finished sending, or either fails. clReader and
+// svReader are the readers of clConn and svConn, which may have buffered
+// some bytes already. It returns the numbers of bytes sent to the server
+// and to the client.
+func relay(clConn net.Conn, clReader io.Reader,
+	svConn net.Conn, svReader io.Reader) (int64, int64) {
+	// Deadlines of the request don't apply to the relay
+	clConn.SetDeadline(time.Time{})
+	svConn.SetDeadline(time.Time{})
+
+	var up, down int64
+	var wg sync.WaitGroup
+	copyTo := func(n *int64, dst net.Conn, src io.Reader) {
+		defer wg.Done()
+		var err error
+		*n, err = io.Copy(dst, src)
+		if err != nil {
+			// Make the other direction fail too
+			clConn.Close()
+			svConn.Close()
+			return
+		}
+		closeWrite(dst)
+	}
+	wg.Add(2)
+	go copyTo(&up, svConn, clReader)
+	go copyTo(&down, clConn, svReader)
+	wg.Wait()
+	return up, down
+}
+
+// handleConnect opens a tunnel to the host in a CONNECT request and relays
+// bytes through it until either side closes.
+func handleConnect(t *transaction, req *Request, conn net.Conn,
+	deadline time.Time) {
+	var svConn net.Conn
+	var svReader io.Reader
+	var err error
+	timeouts := t.st.timeouts
+	if parent := t.st.upstream.parentFor(req.Authority); parent != nil {
+		svConn, svReader, err = parent.connect(req.Authority, timeouts, deadline)
+	} else {
+		svConn, err = net.DialTimeout("tcp", req.Authority, timeouts.Dial)
+		svReader = svConn
+	}
+	if err != nil {
+		log.Println(err)
+		metrics.addDialError()
+		res := ResponseBadGateway
+		if isTimeout(err) {
+			res = ResponseGatewayTimeout
+		}
+		t.sendErrorResponse(res)
+		t.wait()
+		return
+	}
+	defer svConn.Close()
+
+	t.access.Upstream = svConn.RemoteAddr().String()
+	t.sendResponse(ResponseConnectionEstablished, nil)
+	t.wait()
+	if t.aborted {
+		return
+	}
+
+	log.Printf("tunnel opened: %s -> %s\n",
+		conn.RemoteAddr().String(), svConn.RemoteAddr().String())
+	up, down := relay(conn, t.cl.Reader(), svConn, svReader)
+	t.access.Bytes = down
+	t.received = up
+	log.Printf("tunnel closed: up=%d down=%d\n", up, down)
+}
+
+// relayUpgraded relays bytes between conn and svConn after the server has
+// switched the protocol, until either side closes.
+func (t *transaction) relayUpgraded(conn, svConn net.Conn) {
+	log.Printf("upgraded: %s -> %s: %s\n", conn.RemoteAddr().String(),
+		svConn.RemoteAddr().String(), t.req.Headers.Get("upgrade"))
+	up, down := relay(conn, t.cl.Reader(), svConn, t.sv.Reader())
+	t.access.Bytes += down
+	t.received += up
+	log.Printf("upgrade closed: up=%d down=%d\n", up, down)
+}
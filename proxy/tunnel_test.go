@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestConnectTunnel(t *testing.T) {
+	// Echo server
+	ln, accepted := listen(t)
+	defer ln.Close()
+	go func() {
+		conn := <-accepted
+		defer conn.Close()
+		io.Copy(conn, conn)
+	}()
+
+	conn, peer := net.Pipe()
+	go handle(conn)
+	defer peer.Close()
+
+	addr := ln.Addr().String()
+	// Bytes right after the request must be relayed too
+	go io.WriteString(peer,
+		"CONNECT "+addr+" HTTP/1.1\r\nHost: "+addr+"\r\n\r\nping")
+
+	r := bufio.NewReader(peer)
+	status, err := r.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	ExpectEqual(t, "HTTP/1.1 200 Connection established\r\n", status)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.TrimSpace(line) == "" {
+			break
+		}
+	}
+	b := make([]byte, 4)
+	if _, err := io.ReadFull(r, b); err != nil {
+		t.Fatal(err)
+	}
+	ExpectEqual(t, "ping", string(b))
+}
+
+func TestUpgrade(t *testing.T) {
+	// Server switching to an echo protocol after a greeting
+	ln, accepted := listen(t)
+	defer ln.Close()
+	received := make(chan []string, 1)
+	go func() {
+		conn := <-accepted
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		received <- readTestRequestHeader(r)
+		io.WriteString(conn, "HTTP/1.1 101 Switching Protocols\r\n"+
+			"Upgrade: websocket\r\nConnection: Upgrade\r\n\r\nhello")
+		io.Copy(conn, r)
+	}()
+
+	conn, peer := net.Pipe()
+	go handle(conn)
+	defer peer.Close()
+
+	addr := ln.Addr().String()
+	go io.WriteString(peer, "GET http://"+addr+"/chat HTTP/1.1\r\n"+
+		"Host: "+addr+"\r\nConnection: keep-alive, Upgrade\r\n"+
+		"Upgrade: websocket\r\n\r\n")
+
+	lines := <-received
+	header := strings.Join(lines[1:], "\n")
+	if !strings.Contains(header, "Connection: Upgrade\n") ||
+		!strings.Contains(header, "Upgrade: websocket") {
+		t.Errorf("Upgrade wasn't forwarded: %s", header)
+	}
+
+	r := bufio.NewReader(peer)
+	var res []string
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if line = strings.TrimSpace(line); line == "" {
+			break
+		}
+		res = append(res, line)
+	}
+	ExpectEqual(t, "HTTP/1.1 101 Switching Protocols", res[0])
+	header = strings.Join(res[1:], "\n")
+	if !strings.Contains(header, "Connection: Upgrade") ||
+		!strings.Contains(header, "Upgrade: websocket") {
+		t.Errorf("Upgrade wasn't sent back: %s", header)
+	}
+
+	// Bytes both ways are relayed after the response
+	b := make([]byte, 5)
+	if _, err := io.ReadFull(r, b); err != nil {
+		t.Fatal(err)
+	}
+	ExpectEqual(t, "hello", string(b))
+	go io.WriteString(peer, "ping")
+	b = b[:4]
+	if _, err := io.ReadFull(r, b); err != nil {
+		t.Fatal(err)
+	}
+	ExpectEqual(t, "ping", string(b))
+}